@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+// api is the management API of a dev-reverse-proxy server. token is sent as
+// a bearer token when the server sets MGMT_TOKEN. insecure skips TLS
+// certificate verification, for servers behind a self-signed dev cert.
+type api struct {
+	server   string
+	token    string
+	insecure bool
+	// transport replaces the default transport when set, e.g. in tests.
+	transport http.RoundTripper
+}
+
+// insecureTransport is the default transport without certificate
+// verification, shared so connections are still reused.
+var insecureTransport = sync.OnceValue(func() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return t
+})
+
+// httpClient returns a client for the server with the given timeout, 0
+// meaning none.
+func (a api) httpClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if a.insecure {
+		client.Transport = insecureTransport()
+	}
+	if a.transport != nil {
+		client.Transport = a.transport
+	}
+	return client
+}
+
+// newRequest builds a request for path, which starts with a slash, so a
+// trailing slash on the server URL is dropped to avoid "//register".
+func (a api) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(a.server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// registerOptions are the register fields shared by all of a client's
+// registrations.
+type registerOptions struct {
+	UpstreamHost string
+	Labels       map[string]string
+	// TTL asks the server for a heartbeat timeout other than its default.
+	TTL time.Duration
+	// Wildcard also routes every subdomain of the registered one.
+	Wildcard bool
+}
+
+// signHeartbeat adds the X-Devrp-Timestamp and X-Devrp-Signature headers:
+// the hex HMAC-SHA256 of id followed by the Unix millisecond timestamp,
+// keyed with the secret from the registration. The server rejects stale or
+// replayed timestamps, so a sniffed heartbeat can't be reused.
+func signHeartbeat(req *http.Request, id, secret string, now time.Time) {
+	if secret == "" {
+		return
+	}
+	timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+	req.Header.Set(protocol.TimestampHeader, timestamp)
+	req.Header.Set(protocol.SignatureHeader, protocol.HeartbeatSignature(secret, id, timestamp))
+}
+
+// register registers id once. ctx bounds the whole request, so a server
+// that accepts the connection but never answers can't block the client.
+func (a api) register(ctx context.Context, id string, port int, opts registerOptions) (*protocol.RegisterResponse, error) {
+	payload := protocol.RegisterRequest{
+		ID:         id,
+		Port:       port,
+		Host:       opts.UpstreamHost,
+		Labels:     opts.Labels,
+		Wildcard:   opts.Wildcard,
+		TTLSeconds: int(opts.TTL.Round(time.Second) / time.Second),
+	}
+	body, _ := json.Marshal(payload)
+
+	req, err := a.newRequest("POST", "/register", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.httpClient(0).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result protocol.RegisterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode < 400 {
+		return nil, fmt.Errorf("invalid register response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return nil, &statusError{Op: "register", Code: resp.StatusCode, Status: resp.Status, Message: result.Message}
+	}
+	return &result, nil
+}
+
+// statusError is a request the server answered with an HTTP error. Op names
+// the request, e.g. "register".
+type statusError struct {
+	Op      string
+	Code    int
+	Status  string
+	Message string
+}
+
+func (e *statusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s failed: %s: %s", e.Op, e.Status, e.Message)
+	}
+	return e.Op + " failed: " + e.Status
+}
+
+// registerWithRetry retries register with exponential backoff from 1s up to
+// 16s until timeout passes, e.g. while the server is still starting. Errors
+// the server answers with 4xx, like an invalid subdomain, fail right away.
+// So do certificate errors. A single attempt can't outlast timeout either.
+func (a api) registerWithRetry(ctx context.Context, id string, port int, opts registerOptions, timeout time.Duration) (*protocol.RegisterResponse, error) {
+	deadline := time.Now().Add(timeout)
+	delay := time.Second
+
+	for {
+		attemptCtx, cancel := context.WithDeadline(ctx, deadline)
+		resp, err := a.register(attemptCtx, id, port, opts)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, fmt.Errorf("register timed out: no response from the server within %v", timeout)
+		}
+		// 429 means the server throttles registrations, so waiting helps.
+		var se *statusError
+		if err == nil || errors.As(err, &se) && se.Code < 500 && se.Code != http.StatusTooManyRequests {
+			return resp, err
+		}
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			return nil, fmt.Errorf("%w (for a self-signed dev certificate, pass --insecure)", err)
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("%w (gave up after %v)", err, timeout)
+		}
+
+		fmt.Printf("Register failed, retrying in %v: %v\n", delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 16*time.Second)
+	}
+}
+
+// unregisterAll removes regs, giving up on the rest once timeout has passed.
+// It returns each registration's error, nil where it was removed. A
+// registration the server doesn't know counts as removed, e.g. one that
+// already expired.
+func (a api) unregisterAll(regs []registration, timeout time.Duration) []error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := make([]error, len(regs))
+	for i, reg := range regs {
+		err := a.unregister(ctx, reg.ID, reg.Token)
+		var se *statusError
+		if errors.As(err, &se) && se.Code == http.StatusNotFound {
+			err = nil
+		}
+		errs[i] = err
+	}
+	return errs
+}
+
+// unregister removes the registration id, proving ownership with token.
+func (a api) unregister(ctx context.Context, id, token string) error {
+	req, err := a.newRequest("POST", "/unregister?"+ownerQuery(id, token), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	client := a.httpClient(5 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return responseError("unregister", resp)
+	}
+	return nil
+}
+
+// withoutURL drops the request URL from a transport error, since for
+// /heartbeat and /unregister it carries the ownership token.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// ownerQuery encodes the id and ownership token parameters of /heartbeat
+// and /unregister.
+func ownerQuery(id, token string) string {
+	return url.Values{"id": {id}, "token": {token}}.Encode()
+}
+
+// getJSON decodes the JSON response to GET path into v. op names the
+// request in errors.
+func (a api) getJSON(op, path string, v any) error {
+	req, err := a.newRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+
+	client := a.httpClient(5 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return responseError(op, resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// responseError turns an HTTP error response into a statusError, including
+// the message of the server's JSON error body if there is one.
+func responseError(op string, resp *http.Response) *statusError {
+	var body struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return &statusError{Op: op, Code: resp.StatusCode, Status: resp.Status, Message: body.Message}
+}
+
+func (a api) fetchClients() ([]protocol.ClientView, error) {
+	var body struct {
+		Clients []protocol.ClientView `json:"clients"`
+	}
+	if err := a.getJSON("list clients", "/clients", &body); err != nil {
+		return nil, err
+	}
+	return body.Clients, nil
+}
+
+// serverStatus is the part of /status the client uses.
+type serverStatus struct {
+	Status                  string  `json:"status"`
+	HeartbeatTimeoutSeconds float64 `json:"heartbeat_timeout_seconds"`
+}
+
+func (a api) fetchStatus() (*serverStatus, error) {
+	var status serverStatus
+	if err := a.getJSON("status", "/status", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
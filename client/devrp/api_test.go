@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewRequestTrailingSlash(t *testing.T) {
+	for _, server := range []string{
+		"http://localhost:8080",
+		"http://localhost:8080/",
+		"http://localhost:8080//",
+	} {
+		req, err := api{server: server}.newRequest(http.MethodPost, "/register", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", server, err)
+		}
+		if got := req.URL.String(); got != "http://localhost:8080/register" {
+			t.Errorf("%s: request URL = %s, want http://localhost:8080/register", server, got)
+		}
+	}
+
+	req, err := api{server: "https://proxy.example/devrp/"}.newRequest(http.MethodGet, "/clients", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.URL.String(); got != "https://proxy.example/devrp/clients" {
+		t.Errorf("request URL under a path prefix = %s", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// projectConfigName is the file searched for from the working directory
+// upward, so a repository can commit its dev proxy settings.
+const projectConfigName = ".devrp.yaml"
+
+// projectConfig holds the settings a .devrp.yaml can provide. Flags and
+// environment variables take precedence over it.
+type projectConfig struct {
+	Server  string         `yaml:"server"`
+	ID      string         `yaml:"id"`
+	Port    int            `yaml:"port"`
+	Command commandSetting `yaml:"command"`
+}
+
+// commandSetting is the command to run, given either as a list of arguments
+// or as a single string split on whitespace.
+type commandSetting []string
+
+func (c *commandSetting) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*c = strings.Fields(node.Value)
+		return nil
+	}
+	var args []string
+	if err := node.Decode(&args); err != nil {
+		return err
+	}
+	*c = args
+	return nil
+}
+
+// loadProjectConfig reads path, or with an empty path the nearest
+// .devrp.yaml from the working directory upward. Without one it returns an
+// empty config.
+func loadProjectConfig(path string) (projectConfig, error) {
+	var cfg projectConfig
+	if path == "" {
+		var err error
+		if path, err = findProjectConfig(); err != nil || path == "" {
+			return cfg, err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return cfg, fmt.Errorf("%s: invalid port %d", path, cfg.Port)
+	}
+	return cfg, nil
+}
+
+// findProjectConfig returns the path of the nearest .devrp.yaml, or "" if no
+// directory up to the root has one.
+func findProjectConfig() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// fallbackID is the client ID when none is given and none can be derived
+// from the working directory.
+const fallbackID = "myapp"
+
+var nonLabelChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// defaultID derives a client ID from the name of the enclosing git
+// repository, or the working directory outside one, so unconfigured
+// projects don't all register as myapp.
+func defaultID() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return fallbackID
+	}
+	if root := gitRoot(dir); root != "" {
+		dir = root
+	}
+	if id := slugify(filepath.Base(dir)); id != "" {
+		return id
+	}
+	return fallbackID
+}
+
+// gitRoot returns the nearest directory from dir upward that contains .git,
+// which is a directory in a normal clone and a file in worktrees and
+// submodules, or "" outside a repository.
+func gitRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// slugify turns a directory name like "My_Project.v2" into a single valid
+// subdomain label like "my-project-v2", or "" if nothing usable is left.
+func slugify(name string) string {
+	slug := nonLabelChars.ReplaceAllString(strings.ToLower(name), "-")
+	slug = strings.Trim(slug, "-")
+	if len(slug) > 63 {
+		slug = strings.TrimRight(slug[:63], "-")
+	}
+	return slug
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// detectPort polls until the command's process group listens on a TCP port
+// and returns it: preferred if the command listens on it, else the lowest
+// port it listens on. pgid is the group, which startCommand makes the
+// command's PID.
+func detectPort(ctx context.Context, pgid, preferred int, interval, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ports, err := listeningPorts(pgid)
+		if err != nil {
+			return 0, err
+		}
+		if len(ports) > 0 {
+			if slices.Contains(ports, preferred) {
+				return preferred, nil
+			}
+			return slices.Min(ports), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return 0, fmt.Errorf("command not listening on any port after %v", timeout)
+			}
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// listeningPorts returns the TCP ports processes in group pgid listen on,
+// from /proc where available and from lsof otherwise.
+func listeningPorts(pgid int) ([]int, error) {
+	ports, err := procListeningPorts(pgid)
+	if err == nil {
+		return ports, nil
+	}
+	if _, lookErr := exec.LookPath("lsof"); lookErr != nil {
+		return nil, fmt.Errorf("%w, and lsof is not installed", err)
+	}
+	return lsofListeningPorts(pgid)
+}
+
+// lsofListeningPorts asks lsof for the listening TCP sockets of group pgid.
+// Its -F output has one "n" line per socket, e.g. "n*:5173" or
+// "n[::1]:5173".
+func lsofListeningPorts(pgid int) ([]int, error) {
+	out, err := exec.Command("lsof", "-nP", "-a", "-g", strconv.Itoa(pgid), "-iTCP", "-sTCP:LISTEN", "-Fn").Output()
+	// lsof exits 1 when nothing matches.
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return nil, fmt.Errorf("lsof: %w", err)
+	}
+
+	var ports []int
+	for _, line := range strings.Split(string(out), "\n") {
+		name, ok := strings.CutPrefix(strings.TrimSpace(line), "n")
+		if !ok {
+			continue
+		}
+		i := strings.LastIndexByte(name, ':')
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.Atoi(name[i+1:])
+		if err == nil && !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
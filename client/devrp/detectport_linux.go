@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procListeningPorts finds the sockets processes in group pgid hold open
+// under /proc/<pid>/fd and looks up which of them listen in the TCP tables
+// of /proc/<pgid>/net.
+func procListeningPorts(pgid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := make(map[string]bool)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || processGroup(pid) != pgid {
+			continue
+		}
+		dir := filepath.Join("/proc", e.Name(), "fd")
+		fds, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, fd.Name()))
+			if inode, ok := strings.CutPrefix(link, "socket:["); err == nil && ok {
+				inodes[strings.TrimSuffix(inode, "]")] = true
+			}
+		}
+	}
+
+	var ports []int
+	for _, table := range []string{"tcp", "tcp6"} {
+		p, err := listeningInTable(fmt.Sprintf("/proc/%d/net/%s", pgid, table), inodes)
+		if err != nil && table == "tcp" {
+			return nil, err
+		}
+		ports = append(ports, p...)
+	}
+	return ports, nil
+}
+
+// processGroup returns the process group of pid from /proc/<pid>/stat, or
+// -1 if it can't be read. The group is the third field after the command
+// name, which is in parentheses and may itself contain spaces.
+func processGroup(pid int) int {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return -1
+	}
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return -1
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 3 {
+		return -1
+	}
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return -1
+	}
+	return pgrp
+}
+
+// listeningInTable returns the ports of the sockets in inodes that a
+// /proc/net/tcp style table lists in state 0A, LISTEN. Its local_address
+// column holds the address and port in hex, e.g. 00000000:1F90.
+func listeningInTable(path string, inodes map[string]bool) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ports []int
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 || fields[3] != "0A" || !inodes[fields[9]] {
+			continue
+		}
+		_, hexPort, _ := strings.Cut(fields[1], ":")
+		port, err := strconv.ParseUint(hexPort, 16, 16)
+		if err == nil {
+			ports = append(ports, int(port))
+		}
+	}
+	return ports, sc.Err()
+}
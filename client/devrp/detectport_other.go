@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func procListeningPorts(pgid int) ([]int, error) {
+	return nil, errors.New("/proc is not available on this platform")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+type doctorCheck struct {
+	Name string
+	Err  error
+	Hint string
+}
+
+func runDoctor(args []string) {
+	fs, srv := newSubcommandFlags("doctor")
+	fs.Parse(args)
+
+	reachable := checkServerReachable(*srv)
+	healthy := doctorCheck{
+		Name: "server reports healthy status",
+		Err:  errors.New("skipped, server is unreachable"),
+	}
+	if reachable.Err == nil {
+		healthy = checkServerHealthy(*srv)
+	}
+
+	checks := []doctorCheck{
+		reachable,
+		healthy,
+		checkSuffixResolves(getenv("DOMAIN_SUFFIX", defaultDomainSuffix)),
+		checkPortRange(),
+	}
+
+	failed := 0
+	fmt.Println("devrp doctor")
+	for _, c := range checks {
+		if c.Err == nil {
+			fmt.Printf("  [PASS] %s\n", c.Name)
+			continue
+		}
+		failed++
+		fmt.Printf("  [FAIL] %s: %v\n", c.Name, c.Err)
+		if c.Hint != "" {
+			fmt.Printf("         hint: %s\n", c.Hint)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d of %d checks failed\n", failed, len(checks))
+		os.Exit(1)
+	}
+	fmt.Println("\nAll checks passed")
+}
+
+func checkServerReachable(srv api) doctorCheck {
+	c := doctorCheck{
+		Name: "server reachable at " + srv.server,
+		Hint: "start the server with `docker-compose up -d` or point --server/SERVER at it",
+	}
+
+	req, err := srv.newRequest("GET", "/status", nil)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	client := srv.httpClient(5 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	resp.Body.Close()
+	return c
+}
+
+func checkServerHealthy(srv api) doctorCheck {
+	c := doctorCheck{
+		Name: "server reports healthy status",
+		Hint: "check the server logs with `make server-logs`",
+	}
+
+	req, err := srv.newRequest("GET", "/status", nil)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	client := srv.httpClient(5 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		c.Err = errors.New("unauthorized")
+		c.Hint = "the server requires a management token, pass --token or set TOKEN"
+		return c
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.Err = fmt.Errorf("unexpected response: %s", resp.Status)
+		return c
+	}
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		c.Err = fmt.Errorf("invalid status response: %w", err)
+		return c
+	}
+	if status.Status != "ok" {
+		c.Err = fmt.Errorf("status is %q", status.Status)
+	}
+	return c
+}
+
+func checkSuffixResolves(suffix string) doctorCheck {
+	host := "devrp-doctor." + suffix
+	c := doctorCheck{
+		Name: "*." + suffix + " resolves to this machine",
+		Hint: fmt.Sprintf("add \"127.0.0.1 %s\" to /etc/hosts, or use a resolver that maps *.%s to 127.0.0.1", host, suffix),
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.IsLoopback() {
+			return c
+		}
+	}
+	c.Err = fmt.Errorf("%s resolves to %v, not a loopback address", host, addrs)
+	return c
+}
+
+// checkPortRange checks the range PORT_MIN and PORT_MAX configure.
+func checkPortRange() doctorCheck {
+	min, max, err := portRange(0, 0)
+	if err != nil {
+		return doctorCheck{Name: "port range", Err: err, Hint: "fix PORT_MIN/PORT_MAX"}
+	}
+	c := doctorCheck{
+		Name: fmt.Sprintf("can bind a port in %d-%d", min, max),
+		Hint: "free up a port in the range or pass an explicit --port",
+	}
+
+	port, ln, err := reservePort(min, max, 50, false)
+	if err == nil && ln == nil {
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	ln.Close()
+	c.Name = fmt.Sprintf("can bind a port in %d-%d (port %d)", min, max, port)
+	return c
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+func runExport(args []string) {
+	fs, srv := newSubcommandFlags("export")
+	var format string
+	fs.StringVar(&format, "format", "compose", "Output format (compose)")
+	fs.StringVar(&format, "f", "compose", "Output format (shorthand)")
+	fs.Parse(args)
+
+	if format != "compose" {
+		fmt.Printf("Unsupported format %q (supported: compose)\n", format)
+		os.Exit(1)
+	}
+
+	clients, err := srv.fetchClients()
+	if err != nil {
+		fmt.Println("Failed to fetch clients:", err)
+		os.Exit(1)
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	for i, c := range clients {
+		labels, err := composeLabels(c)
+		if err != nil {
+			fmt.Println("Failed to export:", err)
+			os.Exit(1)
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# %s\n", c.Domain)
+		fmt.Println("labels:")
+		for _, label := range labels {
+			fmt.Printf("  - %q\n", label)
+		}
+	}
+}
+
+// composeLabels returns the Traefik Docker provider labels equivalent to the
+// file provider config the server generates for c: one router and service
+// per path mapping, with the names and priorities of the generated ones. It fails for what labels
+// on a single container cannot express, e.g. tcp clients and the register
+// options the server lists in the client's options.
+func composeLabels(c protocol.ClientView) ([]string, error) {
+	if c.Protocol == "tcp" {
+		return nil, fmt.Errorf("%s: tcp clients have no compose label equivalent", c.ID)
+	}
+	if len(c.Options) > 0 {
+		return nil, fmt.Errorf("%s: %s cannot be exported as compose labels", c.ID, strings.Join(c.Options, ", "))
+	}
+	if len(c.EntryPoints) == 0 {
+		return nil, fmt.Errorf("%s: the server does not report its entrypoints; upgrade it to export", c.ID)
+	}
+	ports := c.Ports
+	if len(ports) == 0 {
+		ports = []protocol.PortMapping{{Path: "/", Port: c.Port}}
+	}
+
+	hostRule := "Host(`" + c.Domain + "`)"
+	if c.Wildcard {
+		// $$ escapes the dollar from Compose variable interpolation.
+		hostRule = "(" + hostRule + " || HostRegexp(`^.+\\." + regexp.QuoteMeta(c.Domain) + "$$`))"
+	}
+
+	var middlewares []string
+	if c.Compress {
+		middlewares = append(middlewares, "compress-"+c.ID)
+	}
+
+	labels := []string{"traefik.enable=true"}
+	for i, m := range ports {
+		router, service := protocol.RouterName(c.ID, i), protocol.ServiceName(c.ID, i)
+
+		rule := hostRule
+		if m.Path != "/" {
+			rule += " && PathPrefix(`" + m.Path + "`)"
+		}
+		priority := protocol.MappingPriority(m, ports, c.Priority, c.Wildcard)
+
+		// With a TLS entrypoint the HTTP router only redirects, and the
+		// ~secure copy carries the client's middlewares.
+		addRouter := func(name string, entryPoints string, middlewares []string, tls bool) {
+			prefix := "traefik.http.routers." + name + "."
+			labels = append(labels, prefix+"rule="+rule)
+			if priority != 0 {
+				labels = append(labels, prefix+"priority="+strconv.Itoa(priority))
+			}
+			labels = append(labels, prefix+"entrypoints="+entryPoints)
+			if tls {
+				labels = append(labels, prefix+"tls=true")
+			}
+			if len(middlewares) > 0 {
+				labels = append(labels, prefix+"middlewares="+strings.Join(middlewares, ","))
+			}
+			labels = append(labels, prefix+"service="+service)
+		}
+		if c.TLSEntryPoint == "" {
+			addRouter(router, strings.Join(c.EntryPoints, ","), middlewares, false)
+		} else {
+			addRouter(router, strings.Join(c.EntryPoints, ","), []string{protocol.RedirectMiddlewareName}, false)
+			addRouter(protocol.SecureRouterName(router), c.TLSEntryPoint, middlewares, true)
+		}
+
+		prefix := "traefik.http.services." + service + ".loadbalancer."
+		labels = append(labels, prefix+"server.port="+strconv.Itoa(m.Port))
+		if c.Scheme != "" && c.Scheme != "http" {
+			labels = append(labels, prefix+"server.scheme="+c.Scheme)
+		}
+		if c.Sticky {
+			labels = append(labels, prefix+"sticky.cookie=true")
+		}
+	}
+	if c.Compress {
+		labels = append(labels, "traefik.http.middlewares.compress-"+c.ID+".compress=true")
+	}
+	if c.TLSEntryPoint != "" {
+		labels = append(labels, "traefik.http.middlewares."+protocol.RedirectMiddlewareName+".redirectscheme.scheme=https")
+	}
+	return labels, nil
+}
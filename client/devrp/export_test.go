@@ -0,0 +1,126 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+func TestComposeLabels(t *testing.T) {
+	c := protocol.ClientView{
+		ID:     "myapp",
+		Domain: "myapp.localhost",
+		Port:   3000,
+		Ports: []protocol.PortMapping{
+			{Path: "/", Port: 3000},
+			{Path: "/api", Port: 4000},
+		},
+		EntryPoints: []string{"web", "alt"},
+	}
+	labels, err := composeLabels(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"traefik.enable=true",
+		"traefik.http.routers.sub-myapp.rule=Host(`myapp.localhost`)",
+		"traefik.http.routers.sub-myapp.priority=1001",
+		"traefik.http.routers.sub-myapp.entrypoints=web,alt",
+		"traefik.http.routers.sub-myapp.service=local-myapp",
+		"traefik.http.services.local-myapp.loadbalancer.server.port=3000",
+		"traefik.http.routers.sub-myapp~1.rule=Host(`myapp.localhost`) && PathPrefix(`/api`)",
+		"traefik.http.routers.sub-myapp~1.priority=1004",
+		"traefik.http.routers.sub-myapp~1.entrypoints=web,alt",
+		"traefik.http.routers.sub-myapp~1.service=local-myapp~1",
+		"traefik.http.services.local-myapp~1.loadbalancer.server.port=4000",
+	}
+	if !slices.Equal(labels, want) {
+		t.Errorf("labels:\n%s\nwant:\n%s", strings.Join(labels, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestComposeLabelsTLS(t *testing.T) {
+	c := protocol.ClientView{
+		ID:            "myapp",
+		Domain:        "myapp.localhost",
+		Port:          3000,
+		EntryPoints:   []string{"web"},
+		TLSEntryPoint: "websecure",
+	}
+	labels, err := composeLabels(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range []string{
+		"traefik.http.routers.sub-myapp.middlewares=redirect-to-https",
+		"traefik.http.routers.sub-myapp~secure.entrypoints=websecure",
+		"traefik.http.routers.sub-myapp~secure.tls=true",
+		"traefik.http.routers.sub-myapp~secure.service=local-myapp",
+		"traefik.http.middlewares.redirect-to-https.redirectscheme.scheme=https",
+	} {
+		if !slices.Contains(labels, label) {
+			t.Errorf("missing label %q", label)
+		}
+	}
+}
+
+func TestComposeLabelsOptions(t *testing.T) {
+	c := protocol.ClientView{
+		ID:            "myapp",
+		Domain:        "myapp.localhost",
+		Port:          3000,
+		Scheme:        "https",
+		Sticky:        true,
+		Compress:      true,
+		EntryPoints:   []string{"web"},
+		TLSEntryPoint: "websecure",
+	}
+	labels, err := composeLabels(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range []string{
+		"traefik.http.routers.sub-myapp.middlewares=redirect-to-https",
+		"traefik.http.routers.sub-myapp~secure.middlewares=compress-myapp",
+		"traefik.http.services.local-myapp.loadbalancer.server.scheme=https",
+		"traefik.http.services.local-myapp.loadbalancer.sticky.cookie=true",
+		"traefik.http.middlewares.compress-myapp.compress=true",
+	} {
+		if !slices.Contains(labels, label) {
+			t.Errorf("missing label %q", label)
+		}
+	}
+}
+
+func TestComposeLabelsWildcardEscapesDollar(t *testing.T) {
+	c := protocol.ClientView{
+		ID:          "myapp",
+		Domain:      "myapp.localhost",
+		Port:        3000,
+		Wildcard:    true,
+		EntryPoints: []string{"web"},
+	}
+	labels, err := composeLabels(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "traefik.http.routers.sub-myapp.rule=(Host(`myapp.localhost`) || HostRegexp(`^.+\\.myapp\\.localhost$$`))"
+	if labels[1] != want {
+		t.Errorf("rule label = %q, want %q", labels[1], want)
+	}
+}
+
+func TestComposeLabelsUnsupported(t *testing.T) {
+	tests := map[string]protocol.ClientView{
+		"tcp":            {ID: "db", Protocol: "tcp", EntryPoints: []string{"web"}},
+		"no entrypoints": {ID: "old", Port: 3000},
+		"options":        {ID: "app", Port: 3000, EntryPoints: []string{"web"}, Options: []string{"basic_auth"}},
+	}
+	for name, c := range tests {
+		if _, err := composeLabels(c); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
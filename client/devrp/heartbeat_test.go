@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails the first failures round trips, then answers 200.
+type flakyTransport struct {
+	mu       sync.Mutex
+	failures int
+	calls    []time.Time
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, time.Now())
+	if len(f.calls) <= f.failures {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       io.NopCloser(strings.NewReader(`{"status":"ok"}`)),
+		Request:    req,
+	}, nil
+}
+
+func (f *flakyTransport) callTimes() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Time(nil), f.calls...)
+}
+
+func TestHeartbeatHealthBackoff(t *testing.T) {
+	h := heartbeatHealth{interval: 10 * time.Second}
+	start := time.Now()
+	want := []time.Duration{
+		10 * time.Second, 20 * time.Second, 40 * time.Second,
+		maxHeartbeatBackoff, maxHeartbeatBackoff,
+	}
+	for i, w := range want {
+		if got := h.fail(start.Add(time.Duration(i) * time.Second)); got != w {
+			t.Errorf("failure %d: delay %v, want %v", i+1, got, w)
+		}
+	}
+	if !h.failingSince.Equal(start) {
+		t.Errorf("failingSince = %v, want the first failure %v", h.failingSince, start)
+	}
+	if !h.ok() {
+		t.Error("ok after failures reported no recovery")
+	}
+	if h.ok() {
+		t.Error("ok after ok reported a recovery")
+	}
+	if got := h.fail(start.Add(time.Hour)); got != 10*time.Second {
+		t.Errorf("first failure after recovery: delay %v, want the interval again", got)
+	}
+
+	// An interval above the cap is never shortened.
+	slow := heartbeatHealth{interval: 2 * time.Minute}
+	if got := slow.fail(start); got != 2*time.Minute {
+		t.Errorf("slow interval: delay %v, want 2m", got)
+	}
+}
+
+func TestHeartbeatRecovers(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	transport := &flakyTransport{failures: 3}
+	srv := api{server: "http://devrp.test", transport: transport}
+	regs := []registration{{ID: "myapp", Port: 3000, Token: "token"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- heartbeat(ctx, srv, regs, registerOptions{}, interval, time.Hour, nil) }()
+
+	deadline := time.After(5 * time.Second)
+	for len(transport.callTimes()) < 5 {
+		select {
+		case <-deadline:
+			t.Fatalf("only %d heartbeats sent", len(transport.callTimes()))
+		case <-time.After(interval):
+		}
+	}
+	cancel()
+	if <-done {
+		t.Error("heartbeat asked to exit although heartbeats recovered")
+	}
+
+	// The retries back off from the interval, doubling, and the first
+	// heartbeat after the recovery is back on the interval.
+	calls := transport.callTimes()
+	for i, min := range []time.Duration{interval, 2 * interval, 4 * interval, interval} {
+		if gap := calls[i+1].Sub(calls[i]); gap < min {
+			t.Errorf("gap before attempt %d = %v, want at least %v", i+2, gap, min)
+		}
+	}
+}
+
+func TestHeartbeatExitOnDisconnect(t *testing.T) {
+	const interval, exitAfter = 20 * time.Millisecond, 150 * time.Millisecond
+	transport := &flakyTransport{failures: 1 << 30}
+	srv := api{server: "http://devrp.test", transport: transport}
+	regs := []registration{{ID: "myapp", Port: 3000, Token: "token"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !heartbeat(ctx, srv, regs, registerOptions{}, interval, exitAfter, nil) {
+		t.Fatal("heartbeat returned without asking to exit")
+	}
+
+	calls := transport.callTimes()
+	if failingFor := calls[len(calls)-1].Sub(calls[0]); failingFor < exitAfter {
+		t.Errorf("gave up after failing for %v, want at least %v", failingFor, exitAfter)
+	}
+	// Retries after 20ms, 40ms and 80ms fit in the window before the
+	// last one, which is cut short to end it.
+	if len(calls) < 4 {
+		t.Errorf("%d heartbeats before exiting, want at least 4", len(calls))
+	}
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,98 +12,472 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
+// defaultDomainSuffix is the domain the server appends to registered
+// subdomains unless it sets DOMAIN_SUFFIX.
+const defaultDomainSuffix = "localhost"
+
+// killGracePeriod is how long the command gets to exit after SIGTERM before
+// it is killed.
+const killGracePeriod = 10 * time.Second
+
+// unregisterTimeout bounds how long shutdown waits for the server to drop
+// the registrations, so an unreachable server doesn't hold up the exit.
+const unregisterTimeout = 3 * time.Second
+
+// maxReregisterBackoff caps the wait between attempts to register again
+// after the server forgot a registration.
+const maxReregisterBackoff = time.Minute
+
+// defaultPortMin and defaultPortMax bound the auto-selected port unless
+// --port-min/--port-max or PORT_MIN/PORT_MAX are set.
+const (
+	defaultPortMin = 3000
+	defaultPortMax = 3100
+)
+
+// maxHeartbeatBackoff caps the wait between heartbeats while the server
+// keeps failing them.
+const maxHeartbeatBackoff = time.Minute
+
 type Config struct {
-	Server string
-	ID     string
-	Port   int
+	Server   string
+	Token    string
+	Insecure bool
+	IDs      idList
+	Ports    portList
+	PortMin  int
+	PortMax  int
+	// PortStrategy is how a port is auto-selected: "random" or
+	// "sequential".
+	PortStrategy string
+	UpstreamHost string
+	Labels       labelFlags
+	TTL          time.Duration
+	Wildcard     bool
+	StatusSocket string
+	Warmup       time.Duration
+	WaitForPort  bool
+	DetectPort   bool
+	WaitInterval time.Duration
+	WaitTimeout  time.Duration
+	DryRun       bool
+
+	RegisterTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// ExitOnDisconnect stops the command once heartbeats have failed for
+	// this long; 0 keeps it running.
+	ExitOnDisconnect time.Duration
+}
+
+// subcommands run instead of a command when named by the first non-flag
+// argument, e.g. "client -s URL list". They get their own flags, preceded by
+// the global --server and --token.
+var subcommands = map[string]func(args []string){
+	"doctor":     runDoctor,
+	"export":     runExport,
+	"list":       runList,
+	"status":     runStatus,
+	"unregister": runUnregister,
 }
 
 func main() {
 	cfg, userCmd := parseArgs()
 
+	// Fail before registering, so a typo doesn't leave a route behind until
+	// its heartbeats time out. A dry run reports it instead.
+	if _, err := exec.LookPath(userCmd[0]); err != nil && !cfg.DryRun {
+		fmt.Println("Command not found:", err)
+		os.Exit(127)
+	}
+
 	if cfg.Server == "" {
 		cfg.Server = getenv("SERVER", "http://localhost:8080")
 	}
-	if cfg.ID == "" {
-		cfg.ID = getenv("ID", "myapp")
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("TOKEN")
+	}
+	srv := api{server: cfg.Server, token: cfg.Token, insecure: cfg.Insecure}
+	if len(cfg.IDs) == 0 {
+		// defaultID looks for the git root, so only when ID isn't set.
+		id := os.Getenv("ID")
+		if id == "" {
+			id = defaultID()
+		}
+		cfg.IDs = idList{id}
+	}
+	if cfg.HeartbeatInterval == 0 {
+		d, err := time.ParseDuration(getenv("HEARTBEAT_INTERVAL", "10s"))
+		if err != nil || d <= 0 {
+			fmt.Println("Invalid HEARTBEAT_INTERVAL:", os.Getenv("HEARTBEAT_INTERVAL"))
+			os.Exit(1)
+		}
+		cfg.HeartbeatInterval = d
 	}
 
-	if cfg.Port == 0 {
-		port, err := findFreePort(3000, 3100, 50)
+	// reserved holds an auto-selected port until the command starts.
+	var reserved net.Listener
+	autoPort := len(cfg.Ports) == 0
+	if autoPort {
+		portMin, portMax, err := portRange(cfg.PortMin, cfg.PortMax)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		port, ln, err := reservePort(portMin, portMax, 50, cfg.PortStrategy == "sequential")
 		if err != nil {
-			fmt.Println("Failed to find free port in range 3000–3100")
+			fmt.Printf("Failed to find free port in range %d-%d\n", portMin, portMax)
 			os.Exit(1)
 		}
-		cfg.Port = port
+		cfg.Ports = portList{port}
+		reserved = ln
 	}
 
-	os.Setenv("PORT", strconv.Itoa(cfg.Port))
-
-	if err := register(cfg.Server, cfg.ID, cfg.Port); err != nil {
-		os.Exit(1)
+	if cfg.DryRun {
+		if reserved != nil {
+			reserved.Close()
+		}
+		printDryRun(cfg, userCmd, autoPort && reserved != nil)
+		os.Exit(0)
 	}
 
+	os.Setenv("PORT", strconv.Itoa(cfg.Ports[0]))
+	regs := registrations(cfg.IDs, cfg.Ports)
+
+	status := newStatusReporter(cfg.StatusSocket)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go heartbeat(ctx, cfg.Server, cfg.ID)
+	opts := registerOptions{UpstreamHost: cfg.UpstreamHost, Labels: cfg.Labels, TTL: cfg.TTL, Wildcard: cfg.Wildcard}
+
+	var heartbeats sync.WaitGroup
+	// lost is closed when heartbeats failed for --exit-on-disconnect.
+	lost := make(chan struct{})
+	// connected is set once every registration succeeded. A failed connect
+	// has already removed the ones it made.
+	var connected bool
+	// publicURL is the first registration's URL, e.g. http://api.localhost.
+	var publicURL string
+	// ttl is the heartbeat timeout the server reported, if any.
+	var ttl time.Duration
+	connect := func() error {
+		for i, reg := range regs {
+			resp, err := srv.registerWithRetry(ctx, reg.ID, reg.Port, opts, cfg.RegisterTimeout)
+			if err != nil {
+				srv.unregisterAll(regs[:i], unregisterTimeout)
+				return fmt.Errorf("%s: %w", reg.ID, err)
+			}
+			regs[i].Token = resp.Token
+			regs[i].Secret = resp.HeartbeatSecret
+			url := resp.URL
+			// Servers before the full URL was returned sent the bare domain.
+			if !strings.Contains(url, "://") {
+				url = "http://" + url
+			}
+			if i == 0 {
+				publicURL = url
+				ttl = time.Duration(resp.TTLSeconds) * time.Second
+			}
+			fmt.Printf("Registered %s -> port %d\n", url, reg.Port)
+			if resp.Subdomain != "" && !strings.EqualFold(resp.Subdomain, reg.ID) {
+				fmt.Printf("%s is taken, registered as %s\n", reg.ID, resp.Subdomain)
+				regs[i].ID = resp.Subdomain
+			}
+			status.emit(StatusEvent{
+				Event: "registered",
+				ID:    regs[i].ID,
+				URL:   url,
+				Port:  reg.Port,
+			})
+		}
+
+		warnHeartbeatInterval(srv, cfg.HeartbeatInterval, ttl)
+
+		connected = true
+		heartbeats.Add(1)
+		go func() {
+			defer heartbeats.Done()
+			if heartbeat(ctx, srv, regs, opts, cfg.HeartbeatInterval, cfg.ExitOnDisconnect, status) {
+				close(lost)
+			}
+		}()
+		return nil
+	}
+
+	// warmupDone is closed once a delayed registration has finished or
+	// given up; it is closed right away otherwise.
+	warmupDone := make(chan struct{})
+
+	// shutdown stops the heartbeats and unregisters. Both a signal and the
+	// command exiting call it; the first call does the work and the second
+	// waits for it to finish. Waiting for warmupDone first ensures no
+	// heartbeat goroutine starts after heartbeats.Wait.
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			cancel()
+			<-warmupDone
+			heartbeats.Wait()
+			if !connected {
+				return
+			}
+			errs := srv.unregisterAll(regs, unregisterTimeout)
+			for i, reg := range regs {
+				e := StatusEvent{Event: "unregistered", ID: reg.ID}
+				if errs[i] != nil {
+					fmt.Printf("Failed to unregister %s: %v\n", reg.ID, withoutURL(errs[i]))
+					e.Error = errs[i].Error()
+				} else {
+					fmt.Printf("Unregistered %s\n", reg.ID)
+				}
+				status.emit(e)
+			}
+		})
+	}
+
+	// Registration is delayed until the command listens with --wait-for-port,
+	// which --warmup and --detect-port imply. Otherwise the route exists
+	// before it starts.
+	delayed := cfg.WaitForPort || cfg.Warmup > 0 || cfg.DetectPort
+	if !delayed {
+		if err := connect(); err != nil {
+			fmt.Println("Failed to register:", err)
+			os.Exit(1)
+		}
+	}
 
 	cmd := exec.Command(userCmd[0], userCmd[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	cmd.Env = os.Environ()
+	// With a delayed registration the URL isn't known before the command
+	// starts, so only an up-front registration can pass it on.
+	if publicURL != "" {
+		cmd.Env = append(cmd.Env, "DEVRP_URL="+publicURL)
+		if os.Getenv("PUBLIC_URL") == "" {
+			cmd.Env = append(cmd.Env, "PUBLIC_URL="+publicURL)
+		}
+	}
 
+	exited := make(chan struct{})
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigCh
-		cancel()
-		if cmd.Process != nil {
-			_ = cmd.Process.Signal(syscall.SIGTERM)
+		// Drop the route while the command shuts down, so it gets no more
+		// traffic, instead of only once it has exited.
+		go shutdown()
+		stopCommand(cmd, killGracePeriod, exited)
+	}()
+
+	if reserved != nil {
+		reserved.Close()
+	}
+	if err := startCommand(cmd); err != nil {
+		fmt.Println("Failed to start command:", err)
+		close(warmupDone)
+		shutdown()
+		status.close(time.Second)
+		os.Exit(1)
+	}
+
+	go func() {
+		select {
+		case <-lost:
+			fmt.Printf("Server unreachable for %v, stopping the command\n", cfg.ExitOnDisconnect)
+			stopCommand(cmd, killGracePeriod, exited)
+		case <-exited:
 		}
 	}()
 
-	err := cmd.Run()
-	cancel()
+	// When delayed, register only once the command has bound its ports and
+	// any warm-up period has passed, so Traefik sends it no traffic before.
+	warmupFailed := false
+	if delayed {
+		go func() {
+			defer close(warmupDone)
+			if cfg.DetectPort {
+				detectCommandPort(ctx, cmd.Process.Pid, cfg.Ports, regs, cfg.WaitInterval, cfg.WaitTimeout)
+			}
+			err := warmUp(ctx, cfg.Ports, cfg.WaitInterval, cfg.WaitTimeout, cfg.Warmup)
+			if err == nil {
+				err = connect()
+			}
+			if err != nil && ctx.Err() == nil {
+				fmt.Println("Failed to register:", err)
+				warmupFailed = true
+				stopCommand(cmd, killGracePeriod, exited)
+			}
+		}()
+	} else {
+		close(warmupDone)
+	}
+
+	err := cmd.Wait()
+	close(exited)
+	restoreForeground()
+	// Stop whatever the command left running in its group, e.g. the dev
+	// server of a crashed npm.
+	stopCommand(cmd, killGracePeriod, exited)
 
+	exitCode := 0
 	if err != nil {
+		exitCode = 1
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
+			exitCode = exitErr.ExitCode()
 		}
-		os.Exit(1)
 	}
+	status.emit(StatusEvent{Event: "child_exited", ExitCode: &exitCode})
+
+	shutdown()
+	status.close(time.Second)
+
+	if warmupFailed {
+		exitCode = 1
+	}
+	select {
+	case <-lost:
+		exitCode = 1
+	default:
+	}
+	os.Exit(exitCode)
 }
 
 func parseArgs() (Config, []string) {
 	var cfg Config
+	var configPath string
+	var showVersion bool
 
 	flag.StringVar(&cfg.Server, "server", "", "Server URL (default: http://localhost:8080)")
 	flag.StringVar(&cfg.Server, "s", "", "Server URL (shorthand)")
-	flag.StringVar(&cfg.ID, "id", "", "Client identifier (subdomain)")
-	flag.StringVar(&cfg.ID, "i", "", "Client identifier (shorthand)")
-	flag.IntVar(&cfg.Port, "port", 0, "Port number (auto-selected if not set)")
-	flag.IntVar(&cfg.Port, "p", 0, "Port number (shorthand)")
+	flag.StringVar(&cfg.Token, "token", "", "Management API token, if the server sets MGMT_TOKEN")
+	flag.BoolVar(&cfg.Insecure, "insecure", false, "Skip TLS certificate verification for the server (dev certs only)")
+	flag.Var(&cfg.IDs, "id", "Client identifier (subdomain), repeatable with one --port each")
+	flag.Var(&cfg.IDs, "i", "Client identifier (shorthand)")
+	flag.Var(&cfg.Ports, "port", "Port number, repeatable (auto-selected if not set)")
+	flag.Var(&cfg.Ports, "p", "Port number (shorthand)")
+	flag.Var(&cfg.Ports, "ports", "Comma-separated port numbers, e.g. 3000,9229")
+	flag.IntVar(&cfg.PortMin, "port-min", 0, "Lowest auto-selected port (default 3000, or PORT_MIN)")
+	flag.IntVar(&cfg.PortMax, "port-max", 0, "Highest auto-selected port (default 3100, or PORT_MAX)")
+	flag.StringVar(&cfg.PortStrategy, "port-strategy", "random", "How to auto-select a port: random, or sequential for the lowest free one")
+	flag.Var(&cfg.Labels, "label", "Label as key=value, repeatable, shown on the server's /clients (e.g. team=frontend)")
+	flag.BoolVar(&cfg.Wildcard, "wildcard", false, "Also route every subdomain of the ID, e.g. acme.tenant.localhost for tenant")
+	flag.DurationVar(&cfg.TTL, "ttl", 0, "Heartbeat timeout to ask the server for instead of its default (e.g. 5m)")
+	flag.StringVar(&cfg.UpstreamHost, "upstream-host", "", "Host Traefik should forward to instead of the server's default (e.g. a tunnel endpoint)")
+	flag.StringVar(&cfg.StatusSocket, "status-socket", "", "Unix socket or named pipe to write JSON status events to")
+	flag.DurationVar(&cfg.Warmup, "warmup", 0, "Register only after the port is listening and this long has passed (e.g. 5s)")
+	flag.BoolVar(&cfg.WaitForPort, "wait-for-port", false, "Register only after the command accepts connections on its ports")
+	flag.BoolVar(&cfg.DetectPort, "detect-port", false, "Register the port the command actually listens on, for commands that ignore PORT (Linux, or lsof)")
+	flag.DurationVar(&cfg.WaitInterval, "wait-interval", 250*time.Millisecond, "Poll interval for --wait-for-port and --warmup")
+	flag.DurationVar(&cfg.WaitTimeout, "wait-timeout", 2*time.Minute, "How long to wait for each port before giving up")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", 0, "Time between heartbeats (default 10s, or HEARTBEAT_INTERVAL)")
+	flag.DurationVar(&cfg.RegisterTimeout, "register-timeout", 30*time.Second, "How long to keep trying to register while the server is unreachable, failing or not answering")
+	flag.DurationVar(&cfg.ExitOnDisconnect, "exit-on-disconnect", 0, "Stop the command once heartbeats have failed for this long (e.g. 2m)")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "Print the resolved settings and exit without registering or running the command")
+	flag.BoolVar(&showVersion, "version", false, "Print version information and exit")
+	flag.BoolVar(&showVersion, "v", false, "Print version information and exit (shorthand)")
+	flag.StringVar(&configPath, "config", "", "Project config file (default: nearest "+projectConfigName+" from the working directory up)")
 
 	flag.Parse()
 
+	if showVersion {
+		fmt.Printf("devrp %s (commit %s, built %s)\n", version, cmp.Or(commit, "unknown"), cmp.Or(date, "unknown"))
+		os.Exit(0)
+	}
+
+	if cfg.WaitInterval <= 0 {
+		fmt.Println("--wait-interval must be positive")
+		os.Exit(1)
+	}
+	if cfg.HeartbeatInterval < 0 {
+		fmt.Println("--heartbeat-interval must be positive")
+		os.Exit(1)
+	}
+	if cfg.TTL < 0 || cfg.TTL > 0 && cfg.TTL < time.Second {
+		fmt.Println("--ttl must be at least 1s")
+		os.Exit(1)
+	}
+	if cfg.ExitOnDisconnect < 0 {
+		fmt.Println("--exit-on-disconnect must be positive")
+		os.Exit(1)
+	}
+	if cfg.PortStrategy != "random" && cfg.PortStrategy != "sequential" {
+		fmt.Printf("Invalid --port-strategy %q, expected random or sequential\n", cfg.PortStrategy)
+		os.Exit(1)
+	}
+
+	project, err := loadProjectConfig(configPath)
+	if err != nil {
+		fmt.Println("Failed to load config:", err)
+		os.Exit(1)
+	}
+	// Flags win over environment variables, which win over the file.
+	if cfg.Server == "" && os.Getenv("SERVER") == "" {
+		cfg.Server = project.Server
+	}
+	if len(cfg.IDs) == 0 && os.Getenv("ID") == "" && project.ID != "" {
+		cfg.IDs = idList{project.ID}
+	}
+	if len(cfg.Ports) == 0 && os.Getenv("PORT") == "" && project.Port != 0 {
+		cfg.Ports = portList{project.Port}
+	}
+	if cfg.DetectPort && len(cfg.Ports) > 1 {
+		fmt.Println("--detect-port only works with a single port")
+		os.Exit(1)
+	}
+	// Several IDs are paired with the ports in order, e.g. -i web -p 3000
+	// -i api -p 4000.
+	if len(cfg.IDs) > 1 && len(cfg.IDs) != len(cfg.Ports) {
+		fmt.Printf("--id given %d times but %d port(s): pair each --id with a --port\n", len(cfg.IDs), len(cfg.Ports))
+		os.Exit(1)
+	}
+
 	args := flag.Args()
+	if len(args) == 0 && len(project.Command) > 0 {
+		return cfg, project.Command
+	}
 	if len(args) == 0 {
 		fmt.Println("Usage: client [options] -- <command> [args...]")
+		fmt.Println("       client [-s URL] list")
+		fmt.Println("       client [-s URL] status [id]")
+		fmt.Println("       client [-s URL] unregister --client-token TOKEN <id>")
+		fmt.Println("       client doctor [-s URL]")
+		fmt.Println("       client export [-s URL] [--format compose]")
 		fmt.Println("\nOptions:")
 		flag.PrintDefaults()
 		fmt.Println("\nExamples:")
 		fmt.Println("  client -s http://localhost:8080 -i myapp -- npm run dev")
 		fmt.Println("  client --server http://localhost:8080 --id api -p 3035 -- node server.js")
 		fmt.Println("  SERVER=http://localhost:8080 ID=api client -- node server.js")
+		fmt.Println("  client -i api --ports 3000,9229 -- node --inspect=9229 server.js")
 		os.Exit(1)
 	}
 
+	// A command named like a subcommand can still be run after --.
+	if run, ok := subcommands[args[0]]; ok && os.Args[len(os.Args)-len(args)-1] != "--" {
+		var global []string
+		if cfg.Server != "" {
+			global = append(global, "--server", cfg.Server)
+		}
+		if cfg.Token != "" {
+			global = append(global, "--token", cfg.Token)
+		}
+		if cfg.Insecure {
+			global = append(global, "--insecure")
+		}
+		run(append(global, args[1:]...))
+		os.Exit(0)
+	}
+
 	delimIdx := -1
 	for i, arg := range args {
 		if arg == "--" {
@@ -128,6 +501,141 @@ func parseArgs() (Config, []string) {
 	return cfg, userCmd
 }
 
+// newSubcommandFlags returns a flag set with the shared -s/--server, --token
+// and --insecure flags, defaulting to SERVER and TOKEN.
+func newSubcommandFlags(name string) (*flag.FlagSet, *api) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	a := &api{}
+	def := getenv("SERVER", "http://localhost:8080")
+	fs.StringVar(&a.server, "server", def, "Server URL")
+	fs.StringVar(&a.server, "s", def, "Server URL (shorthand)")
+	fs.StringVar(&a.token, "token", os.Getenv("TOKEN"), "Management API token")
+	fs.BoolVar(&a.insecure, "insecure", false, "Skip TLS certificate verification for the server (dev certs only)")
+	return fs, a
+}
+
+// portList collects repeated -p/--port flags and comma-separated --ports.
+type portList []int
+
+func (p *portList) String() string {
+	parts := make([]string, len(*p))
+	for i, port := range *p {
+		parts[i] = strconv.Itoa(port)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *portList) Set(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q", part)
+		}
+		*p = append(*p, port)
+	}
+	return nil
+}
+
+// idList collects repeated -i/--id flags.
+type idList []string
+
+func (l *idList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *idList) Set(v string) error {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return errors.New("empty id")
+	}
+	if slices.Contains(*l, v) {
+		return fmt.Errorf("id %q given twice", v)
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// labelFlags collects repeated --label key=value flags.
+type labelFlags map[string]string
+
+func (l *labelFlags) String() string {
+	parts := make([]string, 0, len(*l))
+	for k, v := range *l {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *labelFlags) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid label %q, expected key=value", v)
+	}
+	if *l == nil {
+		*l = make(labelFlags)
+	}
+	(*l)[key] = value
+	return nil
+}
+
+// registration is one subdomain -> port mapping the client keeps alive.
+// Token is the ownership token the server returned when registering it,
+// and Secret the key its heartbeats are signed with.
+type registration struct {
+	ID     string
+	Port   int
+	Token  string
+	Secret string
+}
+
+// registrations pairs several ids with the ports in order. A single id gets
+// the first port and every further port is registered as <id>-<port>, e.g.
+// api and api-9229.
+func registrations(ids []string, ports []int) []registration {
+	regs := make([]registration, len(ports))
+	for i, port := range ports {
+		switch {
+		case len(ids) > 1:
+			regs[i] = registration{ID: ids[i], Port: port}
+		case i == 0:
+			regs[i] = registration{ID: ids[0], Port: port}
+		default:
+			regs[i] = registration{ID: fmt.Sprintf("%s-%d", ids[0], port), Port: port}
+		}
+	}
+	return regs
+}
+
+// printDryRun prints what the client would register and run with cfg, once
+// flags, environment variables and the project config are resolved.
+// allocated marks a port picked from the free range, which may be taken by
+// the time of a real run.
+func printDryRun(cfg Config, userCmd []string, allocated bool) {
+	fmt.Println("Dry run, nothing is registered or started:")
+	fmt.Printf("  Server:     %s\n", cfg.Server)
+	if cfg.Token != "" {
+		fmt.Println("  Token:      set")
+	}
+	fmt.Printf("  ID:         %s\n", cfg.IDs.String())
+	ports := cfg.Ports.String()
+	switch {
+	case allocated:
+		ports += " (would allocate, free now)"
+	case len(cfg.Ports) == 1 && os.Getenv("PORT") == ports:
+		ports += " (from PORT)"
+	}
+	fmt.Printf("  Ports:      %s\n", ports)
+	for _, reg := range registrations(cfg.IDs, cfg.Ports) {
+		fmt.Printf("  Register:   %s -> port %d\n", reg.ID, reg.Port)
+	}
+	fmt.Printf("  Heartbeat:  every %v\n", cfg.HeartbeatInterval)
+	command := strings.Join(userCmd, " ")
+	if _, err := exec.LookPath(userCmd[0]); err != nil {
+		command += " (not found)"
+	}
+	fmt.Printf("  Command:    %s\n", command)
+}
+
 func getenv(k, def string) string {
 	v := os.Getenv(k)
 	if v == "" {
@@ -136,67 +644,271 @@ func getenv(k, def string) string {
 	return v
 }
 
-func findFreePort(min, max, attempts int) (int, error) {
+// portRange returns the range ports are auto-selected from: the flag values
+// if set, else PORT_MIN and PORT_MAX, else 3000-3100.
+func portRange(flagMin, flagMax int) (int, int, error) {
+	bound := func(flagValue int, env string, def int) (int, error) {
+		if flagValue != 0 {
+			return flagValue, nil
+		}
+		v := os.Getenv(env)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", env, v)
+		}
+		return n, nil
+	}
+	portMin, err := bound(flagMin, "PORT_MIN", defaultPortMin)
+	if err != nil {
+		return 0, 0, err
+	}
+	portMax, err := bound(flagMax, "PORT_MAX", defaultPortMax)
+	if err != nil {
+		return 0, 0, err
+	}
+	if portMin < 1 || portMax > 65535 || portMin >= portMax {
+		return 0, 0, fmt.Errorf("invalid port range %d-%d, expected min < max within 1-65535", portMin, portMax)
+	}
+	return portMin, portMax, nil
+}
+
+// reservePort picks a free port in [min, max] and returns it together with
+// the listener holding it, so nothing else can take the port while the
+// client registers. The caller closes the listener right before the command
+// starts; the port can only be lost in the moment between that and the
+// command binding it. With PORT set, that port is returned without a
+// listener.
+//
+// Random selection tries up to attempts ports, so clients sharing the range
+// rarely race for the same one. Sequential selection tries every port from
+// min upward and returns the lowest free one.
+func reservePort(min, max, attempts int, sequential bool) (int, net.Listener, error) {
 	v := os.Getenv("PORT")
 	if v != "" {
 		p, err := strconv.Atoi(v)
 		if err == nil {
-			return p, nil
+			return p, nil, nil
+		}
+	}
+	if sequential {
+		for p := min; p <= max; p++ {
+			if ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p)); err == nil {
+				return p, ln, nil
+			}
 		}
+		return 0, nil, errors.New("no free port found")
 	}
 	for range attempts {
 		p := min + rand.Intn(max-min+1)
 		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p))
 		if err == nil {
-			_ = ln.Close()
-			return p, nil
+			return p, ln, nil
 		}
 	}
-	return 0, errors.New("no free port found")
+	return 0, nil, errors.New("no free port found")
 }
 
-func register(server, id string, port int) error {
-	payload := map[string]any{
-		"id":   id,
-		"port": port,
+// detectCommandPort waits for the command to listen and, if it picked a
+// port other than the one in PORT, registers that one instead. When the
+// port can't be detected it keeps PORT, and warmUp then waits for it as
+// with --wait-for-port.
+func detectCommandPort(ctx context.Context, pgid int, ports []int, regs []registration, interval, timeout time.Duration) {
+	port, err := detectPort(ctx, pgid, ports[0], interval, timeout)
+	switch {
+	case ctx.Err() != nil:
+	case err != nil:
+		fmt.Printf("Warning: could not detect the command's port, using %d: %v\n", ports[0], err)
+	case port != ports[0]:
+		fmt.Printf("Command listens on port %d instead of PORT %d, registering %d\n", port, ports[0], port)
+		ports[0] = port
+		regs[0].Port = port
 	}
-	body, _ := json.Marshal(payload)
+}
 
-	resp, err := http.Post(
-		server+"/register",
-		"application/json",
-		bytes.NewReader(body),
-	)
-	if err != nil {
-		return err
+// warmUp waits until something accepts connections on every port, polling
+// every interval for up to timeout per port, then for the warm-up duration.
+func warmUp(ctx context.Context, ports []int, interval, timeout, warmup time.Duration) error {
+	for _, port := range ports {
+		if err := waitForPort(ctx, port, interval, timeout); err != nil {
+			return err
+		}
+	}
+	if warmup == 0 {
+		return nil
 	}
-	defer resp.Body.Close()
+	fmt.Printf("Listening, warming up for %v\n", warmup)
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("register failed: %s", resp.Status)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(warmup):
+		return nil
 	}
-	return nil
 }
 
-func heartbeat(ctx context.Context, server, id string) {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+// waitForPort polls 127.0.0.1:port every interval until it accepts a
+// connection or timeout passes.
+func waitForPort(ctx context.Context, port int, interval, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	for {
+		conn, err := net.DialTimeout("tcp", addr, interval)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
 		select {
 		case <-ctx.Done():
-			req, _ := http.NewRequest("POST", server+"/unregister?id="+id, nil)
-			_, _ = client.Do(req)
-			return
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("port %d not listening after %v", port, timeout)
+			}
+			return ctx.Err()
 		case <-ticker.C:
-			req, _ := http.NewRequest(
-				"POST",
-				server+"/heartbeat?id="+id,
-				nil,
-			)
-			_, _ = client.Do(req)
 		}
 	}
 }
+
+// warnHeartbeatInterval warns when interval doesn't fit in the heartbeat
+// timeout: ttl as the server reported it on registration, or else the
+// server's default from /status.
+func warnHeartbeatInterval(srv api, interval, ttl time.Duration) {
+	timeout := ttl
+	if timeout <= 0 {
+		status, err := srv.fetchStatus()
+		if err != nil || status.HeartbeatTimeoutSeconds <= 0 {
+			return
+		}
+		timeout = time.Duration(status.HeartbeatTimeoutSeconds * float64(time.Second))
+	}
+	if interval >= timeout {
+		fmt.Printf("Warning: heartbeat interval %v is not below the server's heartbeat timeout %v, the route will expire\n", interval, timeout)
+	}
+}
+
+// heartbeatHealth tracks consecutive failed heartbeat rounds, i.e. rounds
+// where the server was unreachable or answered 5xx.
+type heartbeatHealth struct {
+	interval     time.Duration
+	failures     int
+	failingSince time.Time
+}
+
+// fail records a failed round at now and returns the delay until the next
+// one. The first retry keeps the normal interval so a single blip doesn't
+// let the route expire; after that the delay doubles up to
+// maxHeartbeatBackoff.
+func (h *heartbeatHealth) fail(now time.Time) time.Duration {
+	if h.failures == 0 {
+		h.failingSince = now
+	}
+	h.failures++
+	return min(h.interval<<min(h.failures-1, 16), max(h.interval, maxHeartbeatBackoff))
+}
+
+// ok records a successful round and reports whether rounds were failing
+// before it.
+func (h *heartbeatHealth) ok() bool {
+	recovered := h.failures > 0
+	h.failures = 0
+	return recovered
+}
+
+// heartbeat keeps regs alive until ctx is done; shutdown unregisters them
+// afterwards. A registration the server no longer knows, e.g. after it
+// restarted without state, is registered again, backing off while that
+// keeps failing. While the server is unreachable or failing, heartbeats
+// back off too. With exitAfter set, heartbeat returns true once they have
+// failed for that long.
+func heartbeat(ctx context.Context, srv api, regs []registration, opts registerOptions, interval, exitAfter time.Duration, status *statusReporter) bool {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	client := srv.httpClient(5 * time.Second)
+	retryAt := make([]time.Time, len(regs))
+	backoff := make([]time.Duration, len(regs))
+	health := heartbeatHealth{interval: interval}
+
+	reregister := func(i int) {
+		reg := &regs[i]
+		if time.Now().Before(retryAt[i]) {
+			return
+		}
+		regCtx, cancel := context.WithTimeout(ctx, client.Timeout)
+		resp, err := srv.register(regCtx, reg.ID, reg.Port, opts)
+		cancel()
+		if err != nil {
+			backoff[i] = min(max(2*backoff[i], interval), maxReregisterBackoff)
+			retryAt[i] = time.Now().Add(backoff[i])
+			status.emit(StatusEvent{Event: "reconnecting", ID: reg.ID, Error: "re-register failed: " + err.Error()})
+			return
+		}
+		backoff[i], retryAt[i] = 0, time.Time{}
+		reg.Token = resp.Token
+		reg.Secret = resp.HeartbeatSecret
+		if resp.Subdomain != "" {
+			reg.ID = resp.Subdomain
+		}
+		fmt.Printf("Server lost %s, registered it again\n", reg.ID)
+		status.emit(StatusEvent{Event: "registered", ID: reg.ID, URL: resp.URL, Port: reg.Port})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+
+		var failure error
+		for i, reg := range regs {
+			req, _ := srv.newRequest("POST", "/heartbeat?"+ownerQuery(reg.ID, reg.Token), nil)
+			signHeartbeat(req, reg.ID, reg.Secret, time.Now())
+			resp, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				if ctx.Err() != nil {
+					return false
+				}
+				failure = err
+				status.emit(StatusEvent{Event: "reconnecting", ID: reg.ID, Error: err.Error()})
+				continue
+			}
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusNotFound:
+				reregister(i)
+			case resp.StatusCode >= 400:
+				if resp.StatusCode >= 500 {
+					failure = errors.New(resp.Status)
+				}
+				status.emit(StatusEvent{Event: "reconnecting", ID: reg.ID, Error: "heartbeat failed: " + resp.Status})
+			}
+		}
+
+		next := interval
+		if failure == nil {
+			if health.ok() {
+				fmt.Println("Heartbeats succeed again")
+			}
+		} else {
+			next = health.fail(time.Now())
+			failingFor := time.Since(health.failingSince)
+			if exitAfter > 0 {
+				if failingFor >= exitAfter {
+					return true
+				}
+				next = min(next, exitAfter-failingFor)
+			}
+			fmt.Printf("Warning: heartbeat failed %d time(s) in a row, retrying in %v: %v\n", health.failures, next.Round(100*time.Millisecond), withoutURL(failure))
+		}
+		timer.Reset(next)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMain runs the client itself when DEVRP_TEST_MAIN is set, so tests can
+// check its exit status by re-executing the test binary.
+func TestMain(m *testing.M) {
+	if os.Getenv("DEVRP_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runClient re-executes the test binary as the client with args.
+func runClient(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "DEVRP_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+func TestMissingCommand(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer srv.Close()
+
+	out, code := runClient(t, "-s", srv.URL, "-i", "myapp", "-p", "3000", "--", "devrp-no-such-command")
+	if code != 127 {
+		t.Errorf("exit status = %d, want 127\n%s", code, out)
+	}
+	if !strings.Contains(out, "Command not found") {
+		t.Errorf("output %q does not report the missing command", out)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("client made %d requests to the server, want none", n)
+	}
+}
+
+func TestReservePortConcurrent(t *testing.T) {
+	t.Setenv("PORT", "")
+	const clients = 32
+	for _, sequential := range []bool{false, true} {
+		ports := make([]int, clients)
+		listeners := make([]net.Listener, clients)
+		errs := make([]error, clients)
+		var wg sync.WaitGroup
+		for i := range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ports[i], listeners[i], errs[i] = reservePort(41000, 41999, 100, sequential)
+			}()
+		}
+		wg.Wait()
+
+		seen := make(map[int]bool, clients)
+		for i, p := range ports {
+			if errs[i] != nil {
+				t.Errorf("sequential=%t: reservePort: %v", sequential, errs[i])
+				continue
+			}
+			if seen[p] {
+				t.Errorf("sequential=%t: port %d handed out twice", sequential, p)
+			}
+			seen[p] = true
+		}
+		for _, ln := range listeners {
+			if ln != nil {
+				ln.Close()
+			}
+		}
+	}
+}
+
+// holdPorts listens on n consecutive ports from 42000 up and returns the
+// first, keeping them taken until the test ends.
+func holdPorts(t *testing.T, n int) int {
+	t.Helper()
+	for first := 42000; first < 43000; first += n {
+		var held []net.Listener
+		for p := first; p < first+n; p++ {
+			ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p))
+			if err != nil {
+				break
+			}
+			held = append(held, ln)
+		}
+		if len(held) == n {
+			t.Cleanup(func() {
+				for _, ln := range held {
+					ln.Close()
+				}
+			})
+			return first
+		}
+		for _, ln := range held {
+			ln.Close()
+		}
+	}
+	t.Fatalf("no %d consecutive free ports to hold", n)
+	return 0
+}
+
+func TestReservePortExhausted(t *testing.T) {
+	t.Setenv("PORT", "")
+	first := holdPorts(t, 2)
+	for _, sequential := range []bool{false, true} {
+		p, ln, err := reservePort(first, first+1, 20, sequential)
+		if err == nil {
+			ln.Close()
+			t.Fatalf("sequential=%t: got port %d from an exhausted range", sequential, p)
+		}
+		if err.Error() != "no free port found" {
+			t.Errorf("sequential=%t: error %q, want no free port found", sequential, err)
+		}
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	t.Setenv("PORT_MIN", "")
+	t.Setenv("PORT_MAX", "")
+	if min, max, err := portRange(0, 0); err != nil || min != defaultPortMin || max != defaultPortMax {
+		t.Errorf("defaults: got %d-%d, %v", min, max, err)
+	}
+	if min, max, err := portRange(5000, 5001); err != nil || min != 5000 || max != 5001 {
+		t.Errorf("two-port range: got %d-%d, %v", min, max, err)
+	}
+	for _, r := range [][2]int{{5000, 5000}, {5001, 5000}, {0, 70000}} {
+		if _, _, err := portRange(r[0], r[1]); err == nil {
+			t.Errorf("range %d-%d accepted", r[0], r[1])
+		}
+	}
+
+	t.Setenv("PORT_MIN", "6000")
+	t.Setenv("PORT_MAX", "abc")
+	if _, _, err := portRange(0, 0); err == nil {
+		t.Error("invalid PORT_MAX accepted")
+	}
+}
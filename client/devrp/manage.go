@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+func runList(args []string) {
+	fs, srv := newSubcommandFlags("list")
+	fs.Parse(args)
+
+	clients, err := srv.fetchClients()
+	if err != nil {
+		fmt.Println("Failed to fetch clients:", err)
+		os.Exit(1)
+	}
+	if len(clients) == 0 {
+		fmt.Println("No clients registered")
+		return
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Domain < clients[j].Domain })
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tPROTOCOL\tUPSTREAM\tLAST HEARTBEAT")
+	for _, c := range clients {
+		upstream := fmt.Sprintf("%s:%d", c.Host, c.Port)
+		if c.Scheme != "" && c.Protocol != "tcp" {
+			upstream = c.Scheme + "://" + upstream
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Domain, c.Protocol, upstream, heartbeatAge(c.LastHeartbeat))
+	}
+	tw.Flush()
+}
+
+// heartbeatAge renders an RFC 3339 timestamp as e.g. "4s ago", falling back
+// to the raw value if it doesn't parse.
+func heartbeatAge(ts string) string {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return ts
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+func runStatus(args []string) {
+	fs, srv := newSubcommandFlags("status")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: client status [options] [id]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var (
+		v   map[string]any
+		err error
+	)
+	switch fs.NArg() {
+	case 0:
+		v, err = fetchRaw(*srv, "status", "/status")
+	case 1:
+		v, err = fetchRaw(*srv, "get client", "/clients/"+url.PathEscape(fs.Arg(0)))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var se *statusError
+	if errors.As(err, &se) && se.Code == http.StatusNotFound && fs.NArg() == 1 {
+		fmt.Printf("Client %s is not registered\n", fs.Arg(0))
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println("Failed to fetch status:", err)
+		os.Exit(1)
+	}
+
+	out, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(out))
+}
+
+// fetchRaw returns the JSON response to GET path as generic values, for
+// printing fields the client doesn't model.
+func fetchRaw(srv api, op, path string) (map[string]any, error) {
+	var v map[string]any
+	if err := srv.getJSON(op, path, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func runUnregister(args []string) {
+	fs, srv := newSubcommandFlags("unregister")
+	var token string
+	fs.StringVar(&token, "client-token", os.Getenv("CLIENT_TOKEN"), "Ownership token the server returned when the client registered")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: client unregister [options] <id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id := fs.Arg(0)
+	if token == "" {
+		fmt.Println("--client-token is required: the server only removes a registration for its owner")
+		os.Exit(1)
+	}
+
+	if err := srv.unregister(context.Background(), id, token); err != nil {
+		fmt.Println("Failed to unregister:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Unregistered %s\n", id)
+}
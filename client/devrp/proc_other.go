@@ -0,0 +1,33 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+func startCommand(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+// stopCommand asks the command to terminate and kills it once grace has
+// passed, unless exited is closed by then. Process groups aren't available
+// here, so only the direct child is signalled.
+func stopCommand(cmd *exec.Cmd, grace time.Duration, exited <-chan struct{}) {
+	if cmd.Process == nil {
+		return
+	}
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-exited:
+		case <-time.After(grace):
+			_ = cmd.Process.Kill()
+		}
+	}()
+}
+
+func restoreForeground() {}
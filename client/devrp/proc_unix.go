@@ -0,0 +1,76 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// startCommand starts cmd in its own process group, so stopCommand also
+// reaches the processes wrappers like `npm run dev` spawn. When devrp runs in
+// the foreground of a terminal the group takes over the terminal, so the
+// command can still read keyboard input and gets Ctrl+C directly.
+func startCommand(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if isForeground(os.Stdin.Fd()) {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(os.Stdin.Fd())
+	}
+	return cmd.Start()
+}
+
+// stopCommand sends SIGTERM to the command's process group and SIGKILL once
+// grace has passed, unless exited is closed by then.
+func stopCommand(cmd *exec.Cmd, grace time.Duration, exited <-chan struct{}) {
+	if cmd.Process == nil {
+		return
+	}
+	pgid := -cmd.Process.Pid
+	_ = syscall.Kill(pgid, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-exited:
+		case <-time.After(grace):
+			_ = syscall.Kill(pgid, syscall.SIGKILL)
+		}
+	}()
+}
+
+// restoreForeground takes the terminal back after the command exited, so
+// Ctrl+C reaches devrp again while it unregisters.
+func restoreForeground() {
+	fd := os.Stdin.Fd()
+	if !isTerminal(fd) {
+		return
+	}
+	// Changing the foreground group from a background group raises SIGTTOU.
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	pgrp := int32(syscall.Getpgrp())
+	_, _, _ = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&pgrp)))
+}
+
+// isForeground reports whether fd is a terminal whose foreground process
+// group is devrp's.
+func isForeground(fd uintptr) bool {
+	pgrp, ok := foregroundGroup(fd)
+	return ok && pgrp == syscall.Getpgrp()
+}
+
+func isTerminal(fd uintptr) bool {
+	_, ok := foregroundGroup(fd)
+	return ok
+}
+
+func foregroundGroup(fd uintptr) (int, bool) {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	return int(pgrp), errno == 0
+}
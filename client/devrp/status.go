@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// StatusEvent is written as one JSON object per line to the status socket.
+//
+// Events:
+//   - "registered":   the subdomain is registered; ID, URL and Port are set
+//   - "reconnecting": a heartbeat failed; Error describes why
+//   - "child_exited": the wrapped command exited; ExitCode is set
+//   - "unregistered": the client unregistered on shutdown; Error is set if
+//     the server couldn't be reached
+type StatusEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Port     int       `json:"port,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// statusReporter writes status events to a Unix socket or named pipe.
+// A nil reporter, or one whose path could not be opened, is a no-op.
+type statusReporter struct {
+	events chan StatusEvent
+	done   chan struct{}
+}
+
+func newStatusReporter(path string) *statusReporter {
+	if path == "" {
+		return nil
+	}
+
+	w, err := openStatusSocket(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status socket disabled: %v\n", err)
+		return nil
+	}
+
+	r := &statusReporter{
+		events: make(chan StatusEvent, 64),
+		done:   make(chan struct{}),
+	}
+	go r.run(w)
+	return r
+}
+
+func (r *statusReporter) run(w io.WriteCloser) {
+	defer close(r.done)
+	defer w.Close()
+
+	enc := json.NewEncoder(w)
+	for ev := range r.events {
+		if err := enc.Encode(ev); err != nil {
+			// The reader went away; drain without writing.
+			for range r.events {
+			}
+			return
+		}
+	}
+}
+
+// emit queues an event without blocking; events are dropped when the reader
+// can't keep up.
+func (r *statusReporter) emit(ev StatusEvent) {
+	if r == nil {
+		return
+	}
+	ev.Time = time.Now()
+	select {
+	case r.events <- ev:
+	default:
+	}
+}
+
+// close flushes queued events, waiting at most timeout.
+func (r *statusReporter) close(timeout time.Duration) {
+	if r == nil {
+		return
+	}
+	close(r.events)
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+	}
+}
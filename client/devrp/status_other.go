@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openStatusSocket(path string) (io.WriteCloser, error) {
+	return nil, errors.New("status sockets are not supported on this platform")
+}
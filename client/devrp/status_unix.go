@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// openStatusSocket connects to an existing Unix socket, or opens the named
+// pipe at path, creating it if it doesn't exist.
+func openStatusSocket(path string) (io.WriteCloser, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return nil, fmt.Errorf("create named pipe %s: %w", path, err)
+		}
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode := info.Mode(); {
+	case mode&os.ModeSocket != 0:
+		return net.Dial("unix", path)
+	case mode&os.ModeNamedPipe != 0:
+		// O_RDWR keeps the open from blocking until a reader shows up.
+		return os.OpenFile(path, os.O_RDWR, 0)
+	default:
+		return nil, fmt.Errorf("%s is not a socket or named pipe", path)
+	}
+}
@@ -0,0 +1,23 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The headers a signed heartbeat carries: the Unix millisecond timestamp
+// and its HeartbeatSignature.
+const (
+	TimestampHeader = "X-Devrp-Timestamp"
+	SignatureHeader = "X-Devrp-Signature"
+)
+
+// HeartbeatSignature returns the hex HMAC-SHA256 a heartbeat for id at
+// timestamp, in Unix milliseconds, is signed with. secret is the
+// registration's HeartbeatSecret.
+func HeartbeatSignature(secret, id, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"cmp"
+	"strconv"
+)
+
+// NameSeparator joins a router or service name to the suffix of the ones
+// derived from it, e.g. sub-myapp~info, sub-myapp~secure and, for a second
+// path mapping, sub-myapp~1. Subdomains can't contain it, so one client's
+// names never equal another client's, as sub-myapp-info would for a client
+// registered as myapp-info.
+const NameSeparator = "~"
+
+// RedirectMiddlewareName is the shared middleware redirecting HTTP routers
+// to HTTPS when a TLS entrypoint is configured.
+const RedirectMiddlewareName = "redirect-to-https"
+
+// PathPriorityBase is added to the path length for the routers of clients
+// with several port mappings, so the longest matching prefix wins.
+const PathPriorityBase = 1000
+
+// RouterName returns the name of the router for the i-th port mapping of
+// the client with internal ID id.
+func RouterName(id string, i int) string {
+	return mappingName("sub-"+id, i)
+}
+
+// ServiceName returns the name of the service for the i-th port mapping of
+// the client with internal ID id.
+func ServiceName(id string, i int) string {
+	return mappingName("local-"+id, i)
+}
+
+func mappingName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + NameSeparator + strconv.Itoa(i)
+}
+
+// SecureRouterName returns the name of the copy of router served on the TLS
+// entrypoint.
+func SecureRouterName(router string) string {
+	return router + NameSeparator + "secure"
+}
+
+// MappingPriority returns the router priority for mapping m of a client
+// with ports, given the priority and wildcard it registered with. 0 leaves
+// Traefik's rule length default.
+func MappingPriority(m PortMapping, ports []PortMapping, priority int, wildcard bool) int {
+	switch {
+	case wildcard && priority == 0:
+		return wildcardPriority(m, ports)
+	case len(ports) > 1:
+		return cmp.Or(priority, PathPriorityBase) + len(m.Path)
+	}
+	return priority
+}
+
+// wildcardPriority ranks m among a wildcard client's mappings by path
+// length, from 1 up. That keeps the longest prefix winning within the client
+// while staying below the rule length priority of exact Host routers, so a
+// subdomain registered on its own wins over the wildcard.
+func wildcardPriority(m PortMapping, ports []PortMapping) int {
+	priority := 1
+	for _, other := range ports {
+		if len(other.Path) < len(m.Path) {
+			priority++
+		}
+	}
+	return priority
+}
@@ -0,0 +1,122 @@
+// Package protocol holds what the dev-reverse-proxy server and the devrp
+// client must agree on: the management API's JSON bodies, the heartbeat
+// signature, and the Traefik router and service names devrp export
+// reproduces as compose labels.
+package protocol
+
+// PortMapping routes requests whose path starts with Path to Port.
+type PortMapping struct {
+	Path string `json:"path"`
+	Port int    `json:"port"`
+}
+
+// RegisterRequest is the body of POST /register.
+type RegisterRequest struct {
+	ID             string     `json:"id"`
+	Token          string     `json:"token,omitempty"`
+	Port           int        `json:"port"`
+	MaxRequestBody string     `json:"max_request_body,omitempty"`
+	InfoRoot       bool       `json:"info_root,omitempty"`
+	ErrorPage      string     `json:"error_page,omitempty"`
+	Host           string     `json:"host,omitempty"`
+	Scheme         string     `json:"scheme,omitempty"`
+	RateLimit      *RateLimit `json:"rate_limit,omitempty"`
+
+	// Ports adds path prefix mappings next to, or instead of, Port.
+	Ports []PortMapping `json:"ports,omitempty"`
+
+	BasicAuth *BasicAuth `json:"basic_auth,omitempty"`
+
+	// Protocol is "http" (default) or "tcp" for a TLS routed TCP service.
+	Protocol string `json:"protocol,omitempty"`
+
+	// InsecureSkipVerify accepts self-signed certificates from an https app.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// RequestHeaders are set on requests to the app, ResponseHeaders on its
+	// responses. An empty value removes the header.
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+
+	// Labels are free-form metadata, e.g. team=frontend, served back on
+	// /clients for dashboards to group by.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Priority sets the Traefik router priority, e.g. to win over another
+	// router matching the same host. Path mappings add their length to it.
+	Priority int `json:"priority,omitempty"`
+
+	// TTLSeconds overrides the heartbeat timeout for this client, capped at
+	// the server's MAX_TTL.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+
+	// Wildcard also routes every subdomain of the registered one, e.g.
+	// acme.tenant.localhost for tenant, unless another client registered
+	// that name exactly.
+	Wildcard bool `json:"wildcard,omitempty"`
+
+	// Sticky enables cookie based session affinity on the client's
+	// services, for testing code that depends on it locally.
+	Sticky bool `json:"sticky,omitempty"`
+
+	// Compress has Traefik compress the app's responses, for testing how
+	// the app and its clients handle gzip.
+	Compress bool `json:"compress,omitempty"`
+}
+
+// BasicAuth protects a client's routes with a user and either a plaintext
+// Password, which the server hashes, or a bcrypt or apr1 Hash.
+type BasicAuth struct {
+	User     string `json:"user"`
+	Password string `json:"password,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// RateLimit is both the register request field and Traefik's rateLimit
+// middleware: Average requests per second with bursts up to Burst.
+type RateLimit struct {
+	Average int `json:"average" yaml:"average"`
+	Burst   int `json:"burst" yaml:"burst"`
+}
+
+// RegisterResponse is the body of the POST /register response, errors
+// included.
+type RegisterResponse struct {
+	Status string `json:"status"`
+	URL    string `json:"url"`
+	// Subdomain is the name actually assigned, which differs from the
+	// requested one when the server suffixes taken subdomains.
+	Subdomain string `json:"subdomain,omitempty"`
+	Token     string `json:"token,omitempty"`
+	// HeartbeatSecret is the key to sign heartbeats with. Older servers
+	// don't send it, and heartbeats then go unsigned.
+	HeartbeatSecret string `json:"heartbeat_secret,omitempty"`
+	// TTLSeconds is the heartbeat timeout that applies to the client. Older
+	// servers don't send it.
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// ClientView is the JSON form of a client served by /clients and
+// /clients/<id>. Options lists the register options set on the client that
+// devrp export can't turn into compose labels, by their request names.
+type ClientView struct {
+	ID            string            `json:"id"`
+	Domain        string            `json:"domain"`
+	Port          int               `json:"port"`
+	Ports         []PortMapping     `json:"ports"`
+	Host          string            `json:"host"`
+	Scheme        string            `json:"scheme"`
+	Protocol      string            `json:"protocol"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Priority      int               `json:"priority,omitempty"`
+	Wildcard      bool              `json:"wildcard,omitempty"`
+	Sticky        bool              `json:"sticky,omitempty"`
+	Compress      bool              `json:"compress,omitempty"`
+	Options       []string          `json:"options,omitempty"`
+	EntryPoints   []string          `json:"entrypoints"`
+	TLSEntryPoint string            `json:"tls_entrypoint,omitempty"`
+	TTLSeconds    int               `json:"ttl_seconds"`
+	RegisteredAt  string            `json:"registered_at"`
+	LastHeartbeat string            `json:"last_heartbeat"`
+}
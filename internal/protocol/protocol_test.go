@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{RouterName("myapp", 0), "sub-myapp"},
+		{RouterName("myapp", 2), "sub-myapp~2"},
+		{ServiceName("myapp", 0), "local-myapp"},
+		{ServiceName("myapp", 1), "local-myapp~1"},
+		{SecureRouterName(RouterName("myapp", 1)), "sub-myapp~1~secure"},
+		// A client registered as myapp-1 keeps apart from myapp's second
+		// mapping.
+		{RouterName("myapp-1", 0), "sub-myapp-1"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestMappingPriority(t *testing.T) {
+	root := PortMapping{Path: "/", Port: 3000}
+	api := PortMapping{Path: "/api", Port: 4000}
+	tests := []struct {
+		name     string
+		m        PortMapping
+		ports    []PortMapping
+		priority int
+		wildcard bool
+		want     int
+	}{
+		{"single mapping", root, []PortMapping{root}, 0, false, 0},
+		{"single mapping with priority", root, []PortMapping{root}, 7, false, 7},
+		{"root of several", root, []PortMapping{root, api}, 0, false, PathPriorityBase + 1},
+		{"prefix of several", api, []PortMapping{root, api}, 0, false, PathPriorityBase + 4},
+		{"prefix with priority", api, []PortMapping{root, api}, 20, false, 24},
+		{"wildcard root", root, []PortMapping{root, api}, 0, true, 1},
+		{"wildcard prefix", api, []PortMapping{root, api}, 0, true, 2},
+		{"wildcard with priority", api, []PortMapping{root, api}, 20, true, 24},
+	}
+	for _, tt := range tests {
+		if got := MappingPriority(tt.m, tt.ports, tt.priority, tt.wildcard); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHeartbeatSignature(t *testing.T) {
+	// echo -n myapp1700000000000 | openssl dgst -sha256 -hmac secret
+	want := "1fd764204979cdeedb9039b870395230ddc8395573c759705e858942bb6c605c"
+	if got := HeartbeatSignature("secret", "myapp", "1700000000000"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRegisterRequestOmitsUnset(t *testing.T) {
+	data, err := json.Marshal(RegisterRequest{ID: "myapp", Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{"id":"myapp","port":3000}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
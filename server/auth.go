@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+// mgmtTokens holds the management API token. After a rotation the previous
+// token stays valid until previousUntil so in-flight clients can switch
+// over. Guarded by ServerManager.mu.
+type mgmtTokens struct {
+	current       []byte
+	previous      []byte
+	previousUntil time.Time
+}
+
+func (t *mgmtTokens) enabled() bool {
+	return len(t.current) > 0
+}
+
+func (t *mgmtTokens) valid(token []byte, now time.Time) bool {
+	if subtle.ConstantTimeCompare(token, t.current) == 1 {
+		return true
+	}
+	return now.Before(t.previousUntil) && subtle.ConstantTimeCompare(token, t.previous) == 1
+}
+
+func bearerToken(r *http.Request) []byte {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	return []byte(strings.TrimSpace(token))
+}
+
+// requireToken rejects requests without a valid management token when
+// MGMT_TOKEN is set, and passes everything through otherwise.
+func (sm *ServerManager) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sm.mu.RLock()
+		ok := !sm.tokens.enabled() || sm.tokens.valid(bearerToken(r), time.Now())
+		sm.mu.RUnlock()
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "error",
+				"message": "unauthorized",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// newToken returns a random, URL-safe client ownership token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenMatches reports whether a client supplied ownership token matches the
+// stored one. An empty token never matches.
+func tokenMatches(given, want string) bool {
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// heartbeatSignatureWindow is how far the timestamp of a signed heartbeat
+// may be from the server's clock.
+const heartbeatSignatureWindow = 30 * time.Second
+
+// verifyHeartbeat checks the X-Devrp-Timestamp and X-Devrp-Signature
+// headers of a heartbeat for id, the id parameter as sent. The ownership
+// token travels in the URL, so anyone who sniffed it could keep the route
+// alive; a signature needs the secret, which is only sent once on
+// registration. Timestamps must be within heartbeatSignatureWindow and
+// increase from one heartbeat to the next, which rejects replays.
+//
+// Unsigned heartbeats are accepted from clients that never signed one, so
+// older clients keep working, and from clients restored from state that
+// predates secrets.
+func (c *Client) verifyHeartbeat(r *http.Request, id string, now time.Time) error {
+	timestamp := r.Header.Get(protocol.TimestampHeader)
+	signature := r.Header.Get(protocol.SignatureHeader)
+	if c.HeartbeatSecret == "" {
+		return nil
+	}
+	if timestamp == "" && signature == "" {
+		if c.lastSignedAt.Load() != 0 {
+			return errors.New("signed heartbeat required")
+		}
+		return nil
+	}
+
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid heartbeat timestamp")
+	}
+	if d := now.Sub(time.UnixMilli(ms)); d > heartbeatSignatureWindow || d < -heartbeatSignatureWindow {
+		return errors.New("heartbeat timestamp outside the allowed window")
+	}
+	want := protocol.HeartbeatSignature(c.HeartbeatSecret, id, timestamp)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(want)) {
+		return errors.New("invalid heartbeat signature")
+	}
+	for {
+		last := c.lastSignedAt.Load()
+		if ms <= last {
+			return errors.New("replayed heartbeat")
+		}
+		if c.lastSignedAt.CompareAndSwap(last, ms) {
+			return nil
+		}
+	}
+}
+
+func writeForbidden(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "error",
+		"message": "invalid token",
+	})
+}
+
+type RotateTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// handleRotateToken swaps in a new management token. It must be wrapped in
+// requireToken, so only holders of a valid token can rotate it.
+func (sm *ServerManager) handleRotateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RotateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": "missing token",
+		})
+		return
+	}
+
+	sm.mu.Lock()
+	if !sm.tokens.enabled() {
+		sm.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": "token auth is disabled",
+		})
+		return
+	}
+
+	previousUntil := time.Now().Add(sm.tokenOverlap)
+	sm.tokens = mgmtTokens{
+		current:       []byte(req.Token),
+		previous:      sm.tokens.current,
+		previousUntil: previousUntil,
+	}
+	sm.mu.Unlock()
+
+	slog.Info("Management token rotated", "event", "rotate_token", "previous_valid_until", previousUntil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":               "rotated",
+		"previous_valid_until": previousUntil.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+// caddyConfig is the subset of Caddy's JSON config the generator emits: one
+// HTTP server with a reverse_proxy route per port mapping.
+type caddyConfig struct {
+	Apps struct {
+		HTTP struct {
+			Servers map[string]caddyServer `json:"servers"`
+		} `json:"http"`
+	} `json:"apps"`
+}
+
+type caddyServer struct {
+	Listen []string     `json:"listen"`
+	Routes []caddyRoute `json:"routes"`
+}
+
+type caddyRoute struct {
+	Match    []caddyMatch   `json:"match"`
+	Handle   []caddyHandler `json:"handle"`
+	Terminal bool           `json:"terminal"`
+}
+
+type caddyMatch struct {
+	Host []string `json:"host"`
+	Path []string `json:"path,omitempty"`
+}
+
+type caddyHandler struct {
+	Handler   string          `json:"handler"`
+	MaxSize   int64           `json:"max_size,omitempty"`
+	Upstreams []caddyUpstream `json:"upstreams,omitempty"`
+	Transport *caddyTransport `json:"transport,omitempty"`
+}
+
+type caddyUpstream struct {
+	Dial string `json:"dial"`
+}
+
+type caddyTransport struct {
+	Protocol string    `json:"protocol"`
+	TLS      *caddyTLS `json:"tls,omitempty"`
+}
+
+type caddyTLS struct {
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// caddyGenerator renders a Caddy JSON config. It covers routing, path
+// prefixes, upstream host and scheme, and max_request_body; registration
+// rejects the Traefik-only options (see traefikOnlyOption) before any client
+// reaches a generator.
+type caddyGenerator struct {
+	sm     *ServerManager
+	listen string
+}
+
+func (g caddyGenerator) Generate(clients []*Client) ([]byte, string, error) {
+	server := caddyServer{Listen: []string{g.listen}, Routes: []caddyRoute{}}
+	// Caddy tries routes in order, so wildcard routes go after all exact
+	// ones and a subdomain registered on its own still wins.
+	var wildcardRoutes []caddyRoute
+
+	for _, client := range clients {
+		// Caddy tries routes in order, so longer prefixes go first.
+		ports := slices.Clone(client.Ports)
+		slices.SortStableFunc(ports, func(a, b protocol.PortMapping) int {
+			return cmp.Compare(len(b.Path), len(a.Path))
+		})
+
+		for _, m := range ports {
+			match := caddyMatch{Host: []string{g.sm.domain(client.Subdomain)}}
+			if client.Wildcard {
+				match.Host = append(match.Host, "*."+match.Host[0])
+			}
+			if m.Path != "/" {
+				match.Path = []string{m.Path + "*"}
+			}
+
+			var handle []caddyHandler
+			if client.MaxRequestBody > 0 {
+				handle = append(handle, caddyHandler{Handler: "request_body", MaxSize: client.MaxRequestBody})
+			}
+			proxy := caddyHandler{
+				Handler:   "reverse_proxy",
+				Upstreams: []caddyUpstream{{Dial: client.upstream(g.sm.upstreamHost, m.Port)}},
+			}
+			if cmp.Or(client.Scheme, g.sm.targetScheme) == "https" {
+				proxy.Transport = &caddyTransport{
+					Protocol: "http",
+					TLS:      &caddyTLS{InsecureSkipVerify: client.InsecureSkipVerify},
+				}
+			}
+			handle = append(handle, proxy)
+
+			route := caddyRoute{
+				Match:    []caddyMatch{match},
+				Handle:   handle,
+				Terminal: true,
+			}
+			if client.Wildcard {
+				wildcardRoutes = append(wildcardRoutes, route)
+			} else {
+				server.Routes = append(server.Routes, route)
+			}
+		}
+	}
+	server.Routes = append(server.Routes, wildcardRoutes...)
+
+	var config caddyConfig
+	config.Apps.HTTP.Servers = map[string]caddyServer{"devrp": server}
+	data, err := json.MarshalIndent(config, "", "  ")
+	return data, "caddy.json", err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+// sseKeepAlive is how often /events sends a comment line, so proxies don't
+// close a stream that has been idle.
+const sseKeepAlive = 15 * time.Second
+
+// clientEvent is a registration change pushed to /events subscribers.
+// Client is set for register and update events.
+type clientEvent struct {
+	Event  string               `json:"event"`
+	ID     string               `json:"id"`
+	Time   string               `json:"time"`
+	Client *protocol.ClientView `json:"client,omitempty"`
+}
+
+// eventMessage is a published event: its name and its clientEvent JSON.
+type eventMessage struct {
+	name string
+	data []byte
+}
+
+// eventHub fans events out to subscribers. A subscriber that falls too far
+// behind is dropped rather than blocking the publisher; it can reconnect and
+// resync from /clients. The zero value is ready to use.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan eventMessage]struct{}
+	closed bool
+}
+
+// subscribe registers a new subscriber. It returns false once the hub is
+// closed.
+func (h *eventHub) subscribe() (chan eventMessage, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	if h.subs == nil {
+		h.subs = make(map[chan eventMessage]struct{})
+	}
+	ch := make(chan eventMessage, 16)
+	h.subs[ch] = struct{}{}
+	return ch, true
+}
+
+func (h *eventHub) unsubscribe(ch chan eventMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) publish(msg eventMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- msg:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every subscription, so open streams return and don't hold up
+// the server's shutdown.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publishEvent sends event for client to all subscribers. Callers must not
+// hold sm.mu.
+func (sm *ServerManager) publishEvent(event string, client *Client) {
+	e := clientEvent{
+		Event: event,
+		ID:    client.Subdomain,
+		Time:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if event == "register" || event == "update" {
+		sm.mu.RLock()
+		view := sm.clientView(client)
+		sm.mu.RUnlock()
+		e.Client = &view
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Failed to marshal event", "event", event, "error", err)
+		return
+	}
+	sm.events.publish(eventMessage{name: event, data: data})
+}
+
+// handleEvents streams registration changes as Server-Sent Events until the
+// client disconnects.
+func (sm *ServerManager) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, ok := sm.events.subscribe()
+	if !ok {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer sm.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx and similar proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.name, msg.data)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+)
+
+// ConfigGenerator renders the configuration of one reverse proxy for the
+// registered clients.
+type ConfigGenerator interface {
+	// Generate returns the config file contents and its file name within
+	// the config directory. Clients are sorted by ID.
+	Generate(clients []*Client) ([]byte, string, error)
+}
+
+// clientConfigPrefix starts the names of the per-client files written with
+// CONFIG_MODE=per-client, e.g. client-api.yml.
+const clientConfigPrefix = "client-"
+
+// perClientGenerator is implemented by generators that can split the
+// config into a file per client, for proxies that watch a directory.
+type perClientGenerator interface {
+	// GeneratePerClient returns the shared config and its file name, and
+	// each client's config by file name, clientConfigPrefix followed by
+	// the client ID.
+	GeneratePerClient(clients []*Client) ([]byte, string, map[string][]byte, error)
+}
+
+// configReloader is implemented by generators whose proxy doesn't watch the
+// config file and has to be told to reload it after a write.
+type configReloader interface {
+	Reload() error
+}
+
+// newConfigGenerator returns the generator for PROXY_BACKEND.
+func newConfigGenerator(backend string, sm *ServerManager) (ConfigGenerator, error) {
+	switch backend {
+	case "", "traefik":
+		return traefikGenerator{sm: sm}, nil
+	case "caddy":
+		return caddyGenerator{sm: sm, listen: cmp.Or(os.Getenv("CADDY_LISTEN"), ":80")}, nil
+	case "nginx":
+		return nginxGenerator{
+			sm:        sm,
+			listen:    cmp.Or(os.Getenv("NGINX_LISTEN"), "80"),
+			reloadCmd: os.Getenv("NGINX_RELOAD_CMD"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown proxy backend %q, expected traefik, caddy or nginx", backend)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleHealthz is the liveness probe: it answers 200 as long as the
+// process serves requests.
+func (sm *ServerManager) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+// handleReadyz is the readiness probe: it answers 200 once the proxy config
+// has been written and 503 before that or while the last write failed.
+func (sm *ServerManager) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	sm.mu.RLock()
+	ready := !sm.lastGenerateTime.IsZero() && sm.lastGenerateError == nil
+	sm.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": "proxy config not written",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"regexp"
+	"strings"
+)
+
+// apr1Alphabet is the base64 variant used by crypt(3) style hashes.
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// htpasswdHashRegex matches the hash formats accepted as-is in basic_auth:
+// bcrypt and Apache MD5 (apr1), both of which Traefik understands.
+var htpasswdHashRegex = regexp.MustCompile(`^(\$2[aby]\$\d{2}\$[./A-Za-z0-9]{53}|\$apr1\$[./A-Za-z0-9]{1,8}\$[./A-Za-z0-9]{22})$`)
+
+func validateHtpasswdHash(hash string) bool {
+	return htpasswdHashRegex.MatchString(hash)
+}
+
+// hashPassword hashes password with Apache's MD5 variant ($apr1$) and a
+// random salt. bcrypt would need a dependency outside the standard library.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	for i, b := range salt {
+		salt[i] = apr1Alphabet[int(b)%len(apr1Alphabet)]
+	}
+	return apr1(password, string(salt)), nil
+}
+
+// apr1 implements the MD5-crypt algorithm with Apache's "$apr1$" magic.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := range 1000 {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return magic + salt + "$" + out.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sampledEvents are high-frequency, low-importance events subject to
+// LOG_SAMPLE_RATE. Everything else, and anything at warn level or above, is
+// always logged.
+var sampledEvents = map[string]bool{
+	"config_generated": true,
+	"heartbeat":        true,
+	"request":          true,
+}
+
+// samplingHandler drops a share of records whose "event" attribute is in
+// sampledEvents, keeping roughly rate of them.
+type samplingHandler struct {
+	slog.Handler
+	rate float64
+
+	// event is set when the handler was derived via WithAttrs with an
+	// "event" attribute.
+	event string
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.rate < 1 && r.Level < slog.LevelWarn {
+		event := h.event
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "event" {
+				event = a.Value.String()
+				return false
+			}
+			return true
+		})
+		if sampledEvents[event] && rand.Float64() >= h.rate {
+			return nil
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	event := h.event
+	for _, a := range attrs {
+		if a.Key == "event" {
+			event = a.Value.String()
+		}
+	}
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), rate: h.rate, event: event}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), rate: h.rate, event: h.event}
+}
+
+// setupLogger installs the default slog logger. LOG_LEVEL (debug, info, warn,
+// error; default info) sets the minimum level, LOG_FORMAT (text or json;
+// default text) the output format, and LOG_SAMPLE_RATE (0 to 1, default 1)
+// the share of sampled events that get logged.
+func setupLogger() {
+	rate := 1.0
+	if v := os.Getenv("LOG_SAMPLE_RATE"); v != "" {
+		if r, err := strconv.ParseFloat(v, 64); err == nil && r >= 0 && r <= 1 {
+			rate = r
+		}
+	}
+
+	opts := &slog.HandlerOptions{}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err == nil {
+		opts.Level = level
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	if rate < 1 {
+		handler = &samplingHandler{Handler: handler, rate: rate}
+	}
+	slog.SetDefault(slog.New(handler))
+}
@@ -1,75 +1,279 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
 )
 
+// Client is a registered client. The API serves it as a ClientView and
+// state.go persists it as a clientState, so it carries no JSON tags of its
+// own; the secrets are excluded explicitly in case it is ever encoded.
 type Client struct {
-	ID            string `json:"id"`
-	Port          int    `json:"port"`
-	Subdomain     string
-	LastHeartbeat time.Time
+	ID             string
+	Port           int
+	Subdomain      string
+	MaxRequestBody int64
+	InfoRoot       bool
+	ErrorPage      string
+	RateLimit      *protocol.RateLimit
+
+	// Ports always holds at least one mapping; a plain Port registration is
+	// the "/" mapping. Port is the first mapping's port.
+	Ports []protocol.PortMapping
+
+	// Token is the ownership token returned from /register and required on
+	// /heartbeat and /unregister.
+	Token string `json:"-"`
+	// HeartbeatSecret is the HMAC key clients sign heartbeats with, see
+	// verifyHeartbeat. Clients restored from older state have none.
+	HeartbeatSecret string `json:"-"`
+
+	// Host overrides the manager's upstream host, e.g. for a client reached
+	// through a tunnel ending on the Traefik host.
+	Host string
+	// Scheme overrides the manager's target scheme, e.g. https for a dev
+	// server with its own certificate.
+	Scheme string
+	// BasicAuth is an htpasswd "user:hash" line required to reach the
+	// client's routes, if set.
+	BasicAuth string `json:"-"`
+
+	RequestHeaders  map[string]string
+	ResponseHeaders map[string]string
+
+	// InsecureSkipVerify skips certificate checks towards an https app.
+	InsecureSkipVerify bool
+	// Protocol is empty for HTTP clients and "tcp" for TCP ones.
+	Protocol string
+	// RegisteredAt is when the subdomain was first registered; updates by
+	// the owner keep it.
+	RegisteredAt time.Time
+	// Labels is client supplied metadata, only reported back on /clients.
+	Labels map[string]string
+	// Priority overrides the Traefik router priority; 0 keeps the default.
+	Priority int
+	// TTL overrides the manager's heartbeat timeout; 0 keeps the default.
+	TTL time.Duration
+	// Wildcard routes every subdomain of the client's domain to it too.
+	Wildcard bool
+	// Sticky makes Traefik pin each browser to a server with a cookie.
+	Sticky bool
+	// Compress gzips the client's responses with Traefik's compress
+	// middleware.
+	Compress bool
+
+	// lastHeartbeat holds Unix nanoseconds and is updated atomically so
+	// heartbeats don't need the manager's write lock.
+	lastHeartbeat atomic.Int64
+	// lastSignedAt is the Unix millisecond timestamp of the last accepted
+	// signed heartbeat, 0 until the client signs one.
+	lastSignedAt atomic.Int64
 }
 
-type TraefikConfig struct {
-	HTTP struct {
-		Routers  map[string]Router  `yaml:"routers,omitempty"`
-		Services map[string]Service `yaml:"services,omitempty"`
-	} `yaml:"http,omitempty"`
+func (c *Client) LastHeartbeat() time.Time {
+	return time.Unix(0, c.lastHeartbeat.Load())
 }
 
-type Router struct {
-	EntryPoints []string `yaml:"entryPoints"`
-	Rule        string   `yaml:"rule"`
-	Service     string   `yaml:"service"`
+func (c *Client) touch(t time.Time) {
+	c.lastHeartbeat.Store(t.UnixNano())
 }
 
-type Service struct {
-	LoadBalancer LoadBalancer `yaml:"loadBalancer"`
-}
-
-type LoadBalancer struct {
-	Servers []Server `yaml:"servers"`
+// upstream returns the host:port Traefik should forward this client's
+// traffic on port to.
+func (c *Client) upstream(defaultHost string, port int) string {
+	host := c.Host
+	if host == "" {
+		host = defaultHost
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 
-type Server struct {
-	URL string `yaml:"url"`
+// serviceURL returns the URL Traefik should forward this client's traffic on
+// port to, e.g. http://[::1]:3000.
+func (c *Client) serviceURL(defaultScheme, defaultHost string, port int) string {
+	u := url.URL{
+		Scheme: cmp.Or(c.Scheme, defaultScheme),
+		Host:   c.upstream(defaultHost, port),
+	}
+	return u.String()
 }
 
 type ServerManager struct {
 	clients          map[string]*Client
 	mu               sync.RWMutex
 	configDir        string
+	stateFile        string
 	heartbeatTimeout time.Duration
+	// maxTTL caps the ttl_seconds clients may register.
+	maxTTL time.Duration
+	// heartbeatCheckInterval is how often expired clients are swept.
+	heartbeatCheckInterval time.Duration
+	startedAt              time.Time
+	selfURL                string
+	upstreamHost           string
+	// domainSuffix is appended to subdomains in router rules and returned
+	// URLs, e.g. localhost or test.
+	domainSuffix string
+	// suffixOnCollision makes a taken subdomain register as <id>-2, <id>-3,
+	// ... instead of failing with 409.
+	suffixOnCollision bool
+	// configFormat is "yaml" or "json", the encoding of dynamic.yml.
+	configFormat string
+	// perClientConfig writes a file per client next to the shared one,
+	// with CONFIG_MODE=per-client.
+	perClientConfig bool
+	// configFilename replaces the generator's file name within configDir,
+	// e.g. for a Traefik setup watching a differently named file.
+	configFilename string
+	// passHostHeader, when set, is emitted on every client service.
+	passHostHeader *bool
+	// healthCheck, when set, is added to every client service.
+	healthCheck *HealthCheck
+	// maxClients caps the number of registered clients; 0 means unlimited.
+	maxClients int
+	// registerLimiter throttles /register per source IP; nil disables it.
+	registerLimiter *ipLimiter
+	// strictUnregister makes unregistering an unknown client answer 404
+	// instead of succeeding as already gone.
+	strictUnregister bool
+	// uniquePorts rejects a registration whose upstream host and port
+	// another subdomain already points at.
+	uniquePorts bool
+	// reserved holds lowercase first labels clients may not register.
+	reserved map[string]bool
+	// subdomainPrefix is prepended to every registered subdomain, e.g.
+	// alice- so alice's myapp is served as alice-myapp.localhost.
+	subdomainPrefix string
+	// targetScheme is the scheme of generated service URLs unless a client
+	// registers its own.
+	targetScheme string
+
+	// entryPoints are the Traefik entrypoints routers are emitted on.
+	entryPoints []string
+	// tlsEntryPoint, when set, is the HTTPS entrypoint every router is also
+	// emitted on, with the plain HTTP router redirecting to it.
+	tlsEntryPoint string
+
+	// probeTimeout, when non-zero, makes registration dial every mapped port
+	// first and reject the request if nothing is listening.
+	probeTimeout time.Duration
+
+	// upstream is nil unless RESOLVE_UPSTREAM is enabled.
+	upstream *upstreamStatus
+
+	tokens       mgmtTokens
+	tokenOverlap time.Duration
+
+	metrics metrics
+	events  eventHub
+
+	// wsConns counts open /ws connections, capped at wsMaxConnections.
+	wsConns          atomic.Int32
+	wsMaxConnections int
+
+	// configDebounce delays config writes so bursts of mutations coalesce.
+	configDebounce time.Duration
+
+	// generator renders the proxy config written to configDir.
+	generator ConfigGenerator
+
+	// regenerate wakes the config writer. It has room for one pending
+	// signal, so mutations during a write coalesce into the next one.
+	regenerate chan struct{}
+	// generation counts config writes. Only the writer goroutine touches it.
+	generation uint64
+
+	// The outcome of the last config write, for /status and /readyz. They
+	// are guarded by mu; lastGenerateTime is zero before the first write.
+	lastGenerateTime  time.Time
+	lastGenerateError error
+	lastRouteCount    int
+}
+
+// defaultReservedSubdomains are first labels that tend to collide with
+// infrastructure routes. RESERVED_SUBDOMAINS replaces the list.
+const defaultReservedSubdomains = "www,admin,traefik,dashboard"
+
+// defaultMaxTTL caps ttl_seconds unless MAX_TTL is set, or HEARTBEAT_TIMEOUT
+// is longer.
+const defaultMaxTTL = 10 * time.Minute
+
+// minHeartbeatTimeout is the shortest HEARTBEAT_TIMEOUT accepted. The expiry
+// sweep runs every half timeout at most, and its ticker needs a positive
+// interval.
+const minHeartbeatTimeout = time.Second
+
+// maxCollisionSuffix is the highest -N suffix tried with SUFFIX_ON_COLLISION.
+const maxCollisionSuffix = 100
+
+// configDebounceMaxFactor caps how long mutations can keep postponing a
+// config write, as a multiple of the debounce delay.
+const configDebounceMaxFactor = 5
+
+// builtinErrorPage selects the error page served by this server instead of
+// a user supplied Traefik service.
+const builtinErrorPage = "builtin"
+
+// domain returns the full host name for subdomain.
+func (sm *ServerManager) domain(subdomain string) string {
+	return subdomain + "." + sm.domainSuffix
 }
 
-type RegisterRequest struct {
-	ID   string `json:"id"`
-	Port int    `json:"port"`
+// publicURL returns the URL a subdomain is reachable at, https when Traefik
+// serves routes on a TLS entrypoint, e.g. http://myapp.localhost.
+func (sm *ServerManager) publicURL(subdomain string) string {
+	scheme := "http"
+	if sm.tlsEntryPoint != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + sm.domain(subdomain)
 }
 
-type RegisterResponse struct {
-	Status  string `json:"status"`
-	URL     string `json:"url"`
-	Message string `json:"message,omitempty"`
+func writeRegisterError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(protocol.RegisterResponse{
+		Status:  "error",
+		Message: message,
+	})
 }
 
-func NewServerManager(configDir string, heartbeatTimeout time.Duration) *ServerManager {
-	return &ServerManager{
+// NewServerManager creates a manager and restores clients from stateFile,
+// if set.
+func NewServerManager(configDir, stateFile string, heartbeatTimeout time.Duration, selfURL, upstreamHost string) *ServerManager {
+	sm := &ServerManager{
 		clients:          make(map[string]*Client),
 		configDir:        configDir,
+		stateFile:        stateFile,
 		heartbeatTimeout: heartbeatTimeout,
+		startedAt:        time.Now(),
+		selfURL:          selfURL,
+		upstreamHost:     upstreamHost,
+		regenerate:       make(chan struct{}, 1),
 	}
+	sm.loadState()
+	return sm
 }
 
 func (sm *ServerManager) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -78,70 +282,420 @@ func (sm *ServerManager) handleRegister(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var req RegisterRequest
+	var req protocol.RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(RegisterResponse{
-			Status:  "error",
-			Message: "invalid json",
-		})
+		writeRegisterError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
 
 	if !validateSubdomain(req.ID) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(RegisterResponse{
-			Status:  "error",
-			Message: "invalid subdomain format",
-		})
+		writeRegisterError(w, http.StatusBadRequest, "invalid subdomain format")
 		return
 	}
 
-	if req.Port < 1 || req.Port > 65535 {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(RegisterResponse{
-			Status:  "error",
-			Message: "invalid port",
-		})
+	// DNS ignores case, so route and detect collisions on the lowercase form.
+	req.ID = strings.ToLower(req.ID)
+
+	// Reserved names are checked before the prefix is added, so admin stays
+	// blocked even though it would be served as <prefix>admin.
+	firstLabel, _, _ := strings.Cut(req.ID, ".")
+	if sm.reserved[firstLabel] {
+		writeRegisterError(w, http.StatusBadRequest, "subdomain reserved")
+		return
+	}
+
+	req.ID = sm.subdomainPrefix + req.ID
+	if !validateSubdomain(req.ID) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid subdomain format")
+		return
+	}
+
+	ports, msg := portMappings(req)
+	if msg != "" {
+		writeRegisterError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	var maxRequestBody int64
+	if req.MaxRequestBody != "" {
+		size, err := parseByteSize(req.MaxRequestBody)
+		if err != nil || size <= 0 {
+			writeRegisterError(w, http.StatusBadRequest, "invalid max_request_body")
+			return
+		}
+		maxRequestBody = size
+	}
+
+	if req.ErrorPage != "" && req.ErrorPage != builtinErrorPage && !validateServiceRef(req.ErrorPage) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid error_page")
+		return
+	}
+
+	if req.RateLimit != nil && (req.RateLimit.Average <= 0 || req.RateLimit.Burst <= 0) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid rate_limit")
+		return
+	}
+
+	req.Host = unbracket(req.Host)
+	if req.Host != "" && !validateHost(req.Host) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid host")
 		return
 	}
 
+	if req.Scheme != "" && !validateScheme(req.Scheme) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid scheme")
+		return
+	}
+
+	if name := traefikOnlyOption(req); name != "" {
+		if _, ok := sm.generator.(traefikGenerator); !ok {
+			writeRegisterError(w, http.StatusBadRequest, name+" requires the traefik backend")
+			return
+		}
+	}
+
+	switch req.Protocol {
+	case "", "http":
+		req.Protocol = ""
+	case "tcp":
+		if msg := sm.validateTCP(req, ports); msg != "" {
+			writeRegisterError(w, http.StatusBadRequest, msg)
+			return
+		}
+	default:
+		writeRegisterError(w, http.StatusBadRequest, "invalid protocol")
+		return
+	}
+
+	if req.InsecureSkipVerify && cmp.Or(req.Scheme, sm.targetScheme) != "https" {
+		writeRegisterError(w, http.StatusBadRequest, "insecure_skip_verify requires scheme https")
+		return
+	}
+
+	if !validateHeaders(req.RequestHeaders) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid request_headers")
+		return
+	}
+	if !validateHeaders(req.ResponseHeaders) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid response_headers")
+		return
+	}
+	if !validateLabels(req.Labels) {
+		writeRegisterError(w, http.StatusBadRequest, "invalid labels")
+		return
+	}
+	if req.Priority < 0 || req.Priority > maxClientPriority {
+		writeRegisterError(w, http.StatusBadRequest, "invalid priority")
+		return
+	}
+	if req.TTLSeconds < 0 {
+		writeRegisterError(w, http.StatusBadRequest, "invalid ttl_seconds")
+		return
+	}
+	// Compare in seconds, so huge values can't overflow the Duration.
+	ttl := sm.maxTTL
+	if req.TTLSeconds < int(sm.maxTTL/time.Second) {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	var basicAuth string
+	if req.BasicAuth != nil {
+		user := req.BasicAuth.User
+		if user == "" || len(user) > 255 || strings.ContainsAny(user, ": \t\r\n") {
+			writeRegisterError(w, http.StatusBadRequest, "invalid basic_auth user")
+			return
+		}
+		hash := req.BasicAuth.Hash
+		switch {
+		case (hash == "") == (req.BasicAuth.Password == ""):
+			writeRegisterError(w, http.StatusBadRequest, "basic_auth needs exactly one of password or hash")
+			return
+		case hash != "" && !validateHtpasswdHash(hash):
+			writeRegisterError(w, http.StatusBadRequest, "invalid basic_auth hash")
+			return
+		case hash == "":
+			var err error
+			if hash, err = hashPassword(req.BasicAuth.Password); err != nil {
+				slog.Error("Failed to hash password", "error", err)
+				writeRegisterError(w, http.StatusInternalServerError, "internal error")
+				return
+			}
+		}
+		basicAuth = user + ":" + hash
+	}
+
+	if sm.probeTimeout > 0 {
+		if err := sm.probe(req.Host, ports); err != nil {
+			slog.Info("Registration probe failed", "event", "probe_failed", "subdomain", req.ID, "error", err)
+			writeRegisterError(w, http.StatusUnprocessableEntity, "nothing listening: "+err.Error())
+			return
+		}
+	}
+
 	internalID := toInternalID(req.ID)
 
+	token, err := newToken()
+	var secret string
+	if err == nil {
+		secret, err = newToken()
+	}
+	if err != nil {
+		slog.Error("Failed to generate token", "error", err)
+		writeRegisterError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	registeredAt := time.Now()
+
 	sm.mu.Lock()
-	if _, exists := sm.clients[internalID]; exists {
+	// An existing entry can be updated by its owner, or taken over once it
+	// has missed heartbeats for half the timeout, e.g. when the app
+	// restarted on a new port and lost its token.
+	existing, exists := sm.clients[internalID]
+	// updated is only set for the owner; a takeover is a new registration
+	// of the subdomain, even though it replaces an entry.
+	updated := false
+	if exists {
+		if tokenMatches(req.Token, existing.Token) {
+			updated = true
+			token = existing.Token
+			secret = cmp.Or(existing.HeartbeatSecret, secret)
+			registeredAt = existing.RegisteredAt
+		} else if time.Since(existing.LastHeartbeat()) < sm.timeout(existing)/2 {
+			subdomain, ok := "", false
+			if sm.suffixOnCollision {
+				subdomain, ok = sm.freeSubdomain(req.ID)
+			}
+			if !ok {
+				sm.mu.Unlock()
+				writeRegisterError(w, http.StatusConflict, "subdomain already in use")
+				return
+			}
+			req.ID = subdomain
+			internalID = toInternalID(subdomain)
+			exists = false
+		}
+	}
+	if sm.uniquePorts {
+		if owner, ok := sm.portOwner(internalID, req.Host, ports); ok {
+			sm.mu.Unlock()
+			slog.Info("Registration rejected, port already in use", "event", "port_in_use", "subdomain", req.ID, "owner", owner)
+			writeRegisterError(w, http.StatusConflict, "port already in use")
+			return
+		}
+	}
+	// Re-registrations replace their entry, so only new clients count.
+	if !exists && sm.maxClients > 0 && len(sm.clients) >= sm.maxClients {
 		sm.mu.Unlock()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(RegisterResponse{
-			Status:  "error",
-			Message: "subdomain already in use",
-		})
+		slog.Warn("Registration rejected, client limit reached", "event", "client_limit", "subdomain", req.ID, "max_clients", sm.maxClients)
+		writeRegisterError(w, http.StatusTooManyRequests, "client limit reached")
 		return
 	}
 
 	client := &Client{
-		ID:            internalID,
-		Port:          req.Port,
-		Subdomain:     req.ID,
-		LastHeartbeat: time.Now(),
+		ID:                 internalID,
+		Port:               ports[0].Port,
+		Ports:              ports,
+		Subdomain:          req.ID,
+		MaxRequestBody:     maxRequestBody,
+		InfoRoot:           req.InfoRoot,
+		ErrorPage:          req.ErrorPage,
+		Host:               req.Host,
+		Scheme:             req.Scheme,
+		BasicAuth:          basicAuth,
+		RequestHeaders:     req.RequestHeaders,
+		InsecureSkipVerify: req.InsecureSkipVerify,
+		Protocol:           req.Protocol,
+		ResponseHeaders:    req.ResponseHeaders,
+		RateLimit:          req.RateLimit,
+		Token:              token,
+		HeartbeatSecret:    secret,
+		RegisteredAt:       registeredAt,
+		Labels:             req.Labels,
+		Priority:           req.Priority,
+		TTL:                ttl,
+		Wildcard:           req.Wildcard,
+		Sticky:             req.Sticky,
+		Compress:           req.Compress,
+	}
+	client.touch(time.Now())
+	if exists && existing.HeartbeatSecret == secret {
+		client.lastSignedAt.Store(existing.lastSignedAt.Load())
 	}
 	sm.clients[internalID] = client
+	clientCount := len(sm.clients)
 	sm.mu.Unlock()
 
-	log.Printf("Client registered: %s -> port %d", client.Subdomain, client.Port)
-	sm.generateConfig()
+	sm.metrics.registrations.Add(1)
+
+	status := "registered"
+	event := "register"
+	if updated {
+		status = "updated"
+		event = "update"
+	}
+	slog.Info("Client "+status, "event", event, "subdomain", client.Subdomain, "port", client.Port,
+		"upstream", client.upstream(sm.upstreamHost, client.Port), "mappings", len(client.Ports), "client_count", clientCount)
+	sm.scheduleConfig()
+	sm.publishEvent(event, client)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(RegisterResponse{
-		Status: "registered",
-		URL:    client.Subdomain + ".localhost",
+	json.NewEncoder(w).Encode(protocol.RegisterResponse{
+		Status:          status,
+		URL:             sm.publicURL(client.Subdomain),
+		Subdomain:       strings.TrimPrefix(client.Subdomain, sm.subdomainPrefix),
+		Token:           client.Token,
+		HeartbeatSecret: client.HeartbeatSecret,
+		TTLSeconds:      int(sm.timeout(client).Seconds()),
 	})
 }
 
+// timeout returns how long client may go without a heartbeat.
+func (sm *ServerManager) timeout(client *Client) time.Duration {
+	return cmp.Or(client.TTL, sm.heartbeatTimeout)
+}
+
+// findClient returns the internal ID and the client registered as id, which
+// is either the name the client registered, without SUBDOMAIN_PREFIX, or the
+// prefixed one /clients lists. Registration always prepends the prefix, so
+// the registered name wins when id matches both forms. Callers must hold
+// sm.mu.
+func (sm *ServerManager) findClient(id string) (string, *Client, bool) {
+	id = strings.ToLower(id)
+	internalID := toInternalID(sm.subdomainPrefix + id)
+	client, ok := sm.clients[internalID]
+	if ok || sm.subdomainPrefix == "" || !strings.HasPrefix(id, sm.subdomainPrefix) {
+		return internalID, client, ok
+	}
+	internalID = toInternalID(id)
+	client, ok = sm.clients[internalID]
+	return internalID, client, ok
+}
+
+// freeSubdomain returns the first of subdomain's first label suffixed with
+// -2, -3, ... that no client holds, e.g. preview-2.team for preview.team.
+// The routers of the holder's extra mappings can't take the candidate's
+// names, as those are joined with protocol.NameSeparator. Callers must hold
+// sm.mu.
+func (sm *ServerManager) freeSubdomain(subdomain string) (string, bool) {
+	first, rest, hasRest := strings.Cut(subdomain, ".")
+	for n := 2; n <= maxCollisionSuffix; n++ {
+		candidate := first + "-" + strconv.Itoa(n)
+		if hasRest {
+			candidate += "." + rest
+		}
+		if !validateSubdomain(candidate) {
+			return "", false
+		}
+		if _, taken := sm.clients[toInternalID(candidate)]; !taken {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// portOwner returns the subdomain of a client other than id that forwards
+// to one of ports on the same upstream host. Callers must hold sm.mu.
+func (sm *ServerManager) portOwner(id, host string, ports []protocol.PortMapping) (string, bool) {
+	c := &Client{Host: host}
+	for _, other := range sm.clients {
+		if other.ID == id {
+			continue
+		}
+		for _, theirs := range other.Ports {
+			for _, ours := range ports {
+				if other.upstream(sm.upstreamHost, theirs.Port) == c.upstream(sm.upstreamHost, ours.Port) {
+					return other.Subdomain, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// probe dials every mapped port on the client's upstream host and returns
+// the first one that refuses the connection or times out.
+func (sm *ServerManager) probe(host string, ports []protocol.PortMapping) error {
+	c := &Client{Host: host}
+	for _, m := range ports {
+		addr := c.upstream(sm.upstreamHost, m.Port)
+		conn, err := net.DialTimeout("tcp", addr, sm.probeTimeout)
+		if err != nil {
+			return fmt.Errorf("port %d: %w", m.Port, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// validateTCP checks a tcp registration only uses what a TCP router
+// supports, returning a validation error message.
+func (sm *ServerManager) validateTCP(req protocol.RegisterRequest, ports []protocol.PortMapping) string {
+	if _, ok := sm.generator.(traefikGenerator); !ok {
+		return "tcp requires the traefik backend"
+	}
+	if sm.tlsEntryPoint == "" {
+		return "tcp requires TLS_ENTRYPOINT, as routing uses the TLS server name"
+	}
+	if len(ports) > 1 || req.InfoRoot || req.ErrorPage != "" || req.MaxRequestBody != "" ||
+		req.RateLimit != nil || req.BasicAuth != nil || req.InsecureSkipVerify || req.Priority != 0 || req.Wildcard || req.Sticky || req.Compress ||
+		len(req.RequestHeaders) > 0 || len(req.ResponseHeaders) > 0 {
+		return "tcp supports a single port and no HTTP options"
+	}
+	return ""
+}
+
+// traefikOnlyOption returns the first option in req that only the Traefik
+// generator implements, or "" if there is none.
+func traefikOnlyOption(req protocol.RegisterRequest) string {
+	switch {
+	case req.BasicAuth != nil:
+		return "basic_auth"
+	case req.RateLimit != nil:
+		return "rate_limit"
+	case len(req.RequestHeaders) > 0:
+		return "request_headers"
+	case len(req.ResponseHeaders) > 0:
+		return "response_headers"
+	case req.ErrorPage != "":
+		return "error_page"
+	case req.InfoRoot:
+		return "info_root"
+	case req.Priority != 0:
+		return "priority"
+	case req.Sticky:
+		return "sticky"
+	case req.Compress:
+		return "compress"
+	}
+	return ""
+}
+
+// portMappings returns the request's port mappings, the legacy Port first as
+// the "/" mapping, or a validation error message.
+func portMappings(req protocol.RegisterRequest) ([]protocol.PortMapping, string) {
+	var ports []protocol.PortMapping
+	if req.Port != 0 || len(req.Ports) == 0 {
+		ports = append(ports, protocol.PortMapping{Path: "/", Port: req.Port})
+	}
+	ports = append(ports, req.Ports...)
+
+	seen := make(map[string]bool, len(ports))
+	for _, m := range ports {
+		if m.Port < 1 || m.Port > 65535 {
+			return nil, "invalid port"
+		}
+		if !validatePathPrefix(m.Path) {
+			return nil, "invalid path"
+		}
+		if seen[m.Path] {
+			return nil, "duplicate path"
+		}
+		seen[m.Path] = true
+	}
+	return ports, ""
+}
+
 func (sm *ServerManager) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -159,12 +713,10 @@ func (sm *ServerManager) handleHeartbeat(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	internalID := toInternalID(id)
-
-	sm.mu.Lock()
-	client, exists := sm.clients[internalID]
+	sm.mu.RLock()
+	internalID, client, exists := sm.findClient(id)
+	sm.mu.RUnlock()
 	if !exists {
-		sm.mu.Unlock()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -174,8 +726,31 @@ func (sm *ServerManager) handleHeartbeat(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	client.LastHeartbeat = time.Now()
-	sm.mu.Unlock()
+	if !tokenMatches(r.URL.Query().Get("token"), client.Token) {
+		writeForbidden(w)
+		return
+	}
+	if err := client.verifyHeartbeat(r, id, time.Now()); err != nil {
+		slog.Info("Heartbeat rejected", "event", "heartbeat_rejected", "subdomain", id, "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if !sm.touchClient(internalID, client, time.Now()) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": "client not found",
+		})
+		return
+	}
+	slog.Debug("Heartbeat", "event", "heartbeat", "subdomain", id)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -183,6 +758,20 @@ func (sm *ServerManager) handleHeartbeat(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// touchClient records a heartbeat at now for client, registered as id, and
+// reports whether it is still registered. Expiry deletes clients under the
+// write lock, so touching under the read lock either keeps the client alive
+// or finds it already gone, without heartbeats contending with each other.
+func (sm *ServerManager) touchClient(id string, client *Client, now time.Time) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if sm.clients[id] != client {
+		return false
+	}
+	client.touch(now)
+	return true
+}
+
 func (sm *ServerManager) handleUnregister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -200,101 +789,353 @@ func (sm *ServerManager) handleUnregister(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	internalID := toInternalID(id)
+	status, ok := sm.removeClient(w, id, r.URL.Query().Get("token"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": status,
+	})
+}
+
+// deleteClient serves DELETE /clients/<id>?token=<token>, the REST form of
+// /unregister. It answers 204 on success.
+func (sm *ServerManager) deleteClient(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/clients/")
+	if _, ok := sm.removeClient(w, id, r.URL.Query().Get("token")); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
+// removeClient unregisters the client registered as id if token owns it,
+// returning "unregistered". An unknown id counts as "already_gone", so a
+// client unregistering twice on shutdown sees no error, unless
+// STRICT_UNREGISTER is set. On failure it writes the error response and
+// returns false.
+func (sm *ServerManager) removeClient(w http.ResponseWriter, id, token string) (string, bool) {
 	sm.mu.Lock()
-	_, exists := sm.clients[internalID]
+	internalID, client, exists := sm.findClient(id)
 	if !exists {
 		sm.mu.Unlock()
+		if !sm.strictUnregister {
+			slog.Debug("Unregister of unknown client", "event", "unregister", "subdomain", id)
+			return "already_gone", true
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status":  "error",
 			"message": "client not found",
 		})
-		return
+		return "", false
+	}
+
+	if !tokenMatches(token, client.Token) {
+		sm.mu.Unlock()
+		writeForbidden(w)
+		return "", false
 	}
 
 	delete(sm.clients, internalID)
+	clientCount := len(sm.clients)
 	sm.mu.Unlock()
 
-	log.Printf("Client unregistered: %s", id)
-	sm.generateConfig()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "unregistered",
-	})
+	sm.metrics.unregistrations.Add(1)
+	slog.Info("Client unregistered", "event", "unregister", "subdomain", client.Subdomain, "port", client.Port, "client_count", clientCount)
+	sm.scheduleConfig()
+	sm.publishEvent("unregister", client)
+	return "unregistered", true
 }
 
-func (sm *ServerManager) checkHeartbeats() {
-	ticker := time.NewTicker(5 * time.Second)
+func (sm *ServerManager) checkHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(sm.heartbeatCheckInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		sm.mu.Lock()
-		now := time.Now()
-		expired := []string{}
-
-		for id, client := range sm.clients {
-			if now.Sub(client.LastHeartbeat) > sm.heartbeatTimeout {
-				expired = append(expired, id)
-			}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
-		for _, id := range expired {
-			delete(sm.clients, id)
-			log.Printf("Client expired (no heartbeat): %s", id)
+		sm.expireClients(time.Now())
+	}
+}
+
+// expireClients removes the clients whose last heartbeat is older than
+// their timeout at now and returns them.
+func (sm *ServerManager) expireClients(now time.Time) []*Client {
+	sm.mu.Lock()
+	expired := []*Client{}
+
+	for _, client := range sm.clients {
+		if now.Sub(client.LastHeartbeat()) > sm.timeout(client) {
+			expired = append(expired, client)
 		}
+	}
 
-		sm.mu.Unlock()
+	for _, client := range expired {
+		delete(sm.clients, client.ID)
+		sm.metrics.expirations.Add(1)
+		slog.Info("Client expired (no heartbeat)", "event", "expire", "subdomain", client.Subdomain, "port", client.Port,
+			"last_heartbeat", client.LastHeartbeat(), "client_count", len(sm.clients))
+	}
+
+	sm.mu.Unlock()
+
+	if len(expired) > 0 {
+		sm.scheduleConfig()
+	}
+	for _, client := range expired {
+		sm.publishEvent("expire", client)
+	}
+	return expired
+}
+
+// scheduleConfig asks the config writer to regenerate the config. It never
+// blocks; a signal already pending covers this request too.
+func (sm *ServerManager) scheduleConfig() {
+	select {
+	case sm.regenerate <- struct{}{}:
+	default:
+	}
+}
 
-		if len(expired) > 0 {
-			sm.generateConfig()
+// runConfigWriter is the only caller of generateConfig and saveState, so
+// writes happen one at a time and always from the latest client snapshot.
+// A write waits for configDebounce without further mutations, but never
+// longer than configDebounceMaxFactor times that since the first one, so
+// bursts coalesce into one write while continuous churn still gets written.
+// When ctx is done a pending config write is flushed and the state saved a
+// last time, capturing the latest heartbeats.
+func (sm *ServerManager) runConfigWriter(ctx context.Context) {
+	var (
+		timer    *time.Timer
+		pending  <-chan time.Time
+		deadline time.Time
+	)
+	write := func() {
+		pending = nil
+		sm.generateConfig()
+		sm.saveState()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush := pending != nil
+			select {
+			case <-sm.regenerate:
+				flush = true
+			default:
+			}
+			if flush {
+				sm.generateConfig()
+			}
+			sm.saveState()
+			return
+		case <-sm.regenerate:
+			if sm.configDebounce <= 0 {
+				write()
+				continue
+			}
+			now := time.Now()
+			if pending == nil {
+				deadline = now.Add(configDebounceMaxFactor * sm.configDebounce)
+			}
+			wait := min(sm.configDebounce, deadline.Sub(now))
+			if timer == nil {
+				timer = time.NewTimer(wait)
+			} else {
+				timer.Reset(wait)
+			}
+			pending = timer.C
+		case <-pending:
+			write()
 		}
 	}
 }
 
 func (sm *ServerManager) generateConfig() {
+	// Clients are replaced, never modified, on re-registration, so the
+	// snapshot can be rendered without holding the lock.
 	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
-	config := TraefikConfig{}
-	config.HTTP.Routers = make(map[string]Router)
-	config.HTTP.Services = make(map[string]Service)
-
-	for subdomain, client := range sm.clients {
-		routerName := "sub-" + subdomain
-		serviceName := "local-" + subdomain
+	clients := make([]*Client, 0, len(sm.clients))
+	for _, client := range sm.clients {
+		clients = append(clients, client)
+	}
+	sm.mu.RUnlock()
+	slices.SortFunc(clients, func(a, b *Client) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
 
-		config.HTTP.Routers[routerName] = Router{
-			EntryPoints: []string{"web"},
-			Rule:        "Host(`" + client.Subdomain + ".localhost`)",
-			Service:     serviceName,
+	var (
+		data  []byte
+		name  string
+		files map[string][]byte
+		err   error
+	)
+	if sm.perClientConfig {
+		data, name, files, err = sm.generator.(perClientGenerator).GeneratePerClient(clients)
+	} else {
+		data, name, err = sm.generator.Generate(clients)
+		files = make(map[string][]byte, 1)
+	}
+	if err != nil {
+		slog.Error("Failed to generate config", "error", err)
+		sm.recordConfigWrite(0, err)
+		return
+	}
+	files[cmp.Or(sm.configFilename, name)] = data
+
+	configPath := filepath.Join(sm.configDir, cmp.Or(sm.configFilename, name))
+	written := 0
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		path := filepath.Join(sm.configDir, name)
+		// Rewriting identical content would still wake the proxy's file
+		// watcher or trigger a reload, so compare against what is on disk.
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, files[name]) {
+			continue
 		}
+		if err := writeFileAtomic(path, files[name], 0644); err != nil {
+			slog.Error("Failed to write config", "path", path, "error", err)
+			sm.recordConfigWrite(0, err)
+			return
+		}
+		written++
+	}
+	removed := 0
+	if sm.perClientConfig {
+		removed = sm.removeStaleClientConfigs(files)
+	}
+	sm.recordConfigWrite(len(clients), nil)
+	if written == 0 && removed == 0 {
+		slog.Debug("Config unchanged", "event", "config_unchanged", "path", configPath, "routes", len(clients))
+		return
+	}
 
-		config.HTTP.Services[serviceName] = Service{
-			LoadBalancer: LoadBalancer{
-				Servers: []Server{
-					{URL: fmt.Sprintf("http://host.docker.internal:%d", client.Port)},
-				},
-			},
+	if r, ok := sm.generator.(configReloader); ok {
+		if err := r.Reload(); err != nil {
+			slog.Error("Failed to reload proxy", "error", err)
 		}
 	}
 
-	data, err := yaml.Marshal(config)
+	sm.generation++
+	sm.metrics.configWrites.Add(1)
+	if sm.perClientConfig {
+		slog.Info("Generated proxy config", "event", "config_generated", "dir", sm.configDir, "written", written, "removed", removed, "generation", sm.generation, "routes", len(clients))
+		return
+	}
+	slog.Info("Generated proxy config", "event", "config_generated", "path", configPath, "generation", sm.generation, "routes", len(clients))
+}
+
+// removeStaleClientConfigs deletes per-client config files that are not in
+// files, i.e. those of clients that unregistered or expired, or were left
+// behind by an earlier run. It returns how many it removed.
+func (sm *ServerManager) removeStaleClientConfigs(files map[string][]byte) int {
+	entries, err := os.ReadDir(sm.configDir)
 	if err != nil {
-		log.Printf("Failed to marshal config: %v", err)
+		slog.Error("Failed to list config directory", "path", sm.configDir, "error", err)
+		return 0
+	}
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if !strings.HasPrefix(name, clientConfigPrefix) || ext != ".yml" && ext != ".json" || files[name] != nil {
+			continue
+		}
+		path := filepath.Join(sm.configDir, name)
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed to remove stale config", "path", path, "error", err)
+			continue
+		}
+		slog.Info("Removed client config", "event", "config_removed", "path", path)
+		removed++
+	}
+	return removed
+}
+
+// recordConfigWrite stores the outcome of a config write. A failed write
+// keeps the route count of the last config that was written.
+func (sm *ServerManager) recordConfigWrite(routes int, err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.lastGenerateTime = time.Now()
+	sm.lastGenerateError = err
+	if err == nil {
+		sm.lastRouteCount = routes
+	}
+}
+
+// handleInfo serves the info page Traefik routes the root path of info_root
+// subdomains to. The internal client ID is the last path segment. It is
+// public on purpose, since Traefik fetches it without the management token,
+// so clients that did not opt into info_root get a 404.
+func (sm *ServerManager) handleInfo(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/info/")
+
+	sm.mu.RLock()
+	client, exists := sm.clients[id]
+	var subdomain string
+	var port int
+	var lastHeartbeat time.Time
+	if exists {
+		exists = client.InfoRoot
+		subdomain = client.Subdomain
+		port = client.Port
+		lastHeartbeat = client.LastHeartbeat()
+	}
+	sm.mu.RUnlock()
+
+	if !exists {
+		http.NotFound(w, r)
 		return
 	}
 
-	configPath := sm.configDir + "/dynamic.yml"
-	if err := os.WriteFile(configPath, data, 0644); err != nil {
-		log.Printf("Failed to write config: %v", err)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	infoTemplate.Execute(w, map[string]any{
+		"Domain":        sm.domain(subdomain),
+		"Port":          port,
+		"LastHeartbeat": lastHeartbeat.Format(time.RFC3339),
+	})
+}
+
+// handleErrorPage serves the builtin error page for /error-page/<id>/<status>,
+// requested by Traefik's errors middleware when a backend returns 5xx. Like
+// the info page it is public, and 404s for clients without error_page builtin.
+func (sm *ServerManager) handleErrorPage(w http.ResponseWriter, r *http.Request) {
+	id, status, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/error-page/"), "/")
+
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 500 || code > 599 {
+		code = http.StatusBadGateway
+	}
+
+	sm.mu.RLock()
+	client, exists := sm.clients[id]
+	domain := ""
+	if exists {
+		exists = client.ErrorPage == builtinErrorPage
+		domain = sm.domain(client.Subdomain)
+	}
+	sm.mu.RUnlock()
+
+	if !exists {
+		http.NotFound(w, r)
 		return
 	}
 
-	log.Printf("Generated Traefik config with %d routes", len(sm.clients))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	errorPageTemplate.Execute(w, map[string]any{
+		"Domain": domain,
+		"Status": code,
+		"Text":   http.StatusText(code),
+	})
 }
 
 func (sm *ServerManager) getStatus(w http.ResponseWriter, r *http.Request) {
@@ -302,8 +1143,39 @@ func (sm *ServerManager) getStatus(w http.ResponseWriter, r *http.Request) {
 	defer sm.mu.RUnlock()
 
 	response := map[string]any{
-		"status":  "ok",
-		"clients": len(sm.clients),
+		"status":                    "ok",
+		"clients":                   len(sm.clients),
+		"heartbeat_timeout_seconds": sm.heartbeatTimeout.Seconds(),
+		"uptime_seconds":            int64(time.Since(sm.startedAt).Seconds()),
+		"config_dir":                sm.configDir,
+		"version":                   version,
+		"commit":                    commit,
+		"build_date":                date,
+	}
+
+	if !sm.lastGenerateTime.IsZero() {
+		config := map[string]any{
+			"last_attempt": sm.lastGenerateTime.Format(time.RFC3339),
+			"routes":       sm.lastRouteCount,
+		}
+		if sm.lastGenerateError != nil {
+			config["error"] = sm.lastGenerateError.Error()
+			response["status"] = "degraded"
+		}
+		response["config"] = config
+	}
+
+	if sm.upstream != nil {
+		upstream := map[string]any{
+			"host":       sm.upstreamHost,
+			"addresses":  sm.upstream.Addresses,
+			"checked_at": sm.upstream.CheckedAt.Format(time.RFC3339),
+		}
+		if sm.upstream.Err != nil {
+			upstream["error"] = sm.upstream.Err.Error()
+			response["status"] = "degraded"
+		}
+		response["upstream"] = upstream
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -314,14 +1186,9 @@ func (sm *ServerManager) getClients(w http.ResponseWriter, r *http.Request) {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	clients := make([]map[string]any, 0, len(sm.clients))
+	clients := make([]protocol.ClientView, 0, len(sm.clients))
 	for _, client := range sm.clients {
-		clients = append(clients, map[string]any{
-			"id":             client.ID,
-			"domain":         client.Subdomain + ".localhost",
-			"port":           client.Port,
-			"last_heartbeat": client.LastHeartbeat.Format(time.RFC3339),
-		})
+		clients = append(clients, sm.clientView(client))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -330,42 +1197,364 @@ func (sm *ServerManager) getClients(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleClient serves /clients/<id>: GET returns the client, DELETE
+// unregisters it.
+func (sm *ServerManager) handleClient(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		sm.getClient(w, r)
+	case http.MethodDelete:
+		sm.deleteClient(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getClient serves GET /clients/<id> with the same fields as one /clients
+// entry.
+func (sm *ServerManager) getClient(w http.ResponseWriter, r *http.Request) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	_, client, exists := sm.findClient(strings.TrimPrefix(r.URL.Path, "/clients/"))
+	if !exists {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": "client not found",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sm.clientView(client))
+}
+
+// clientView fills in the manager's defaults for client. Callers must hold
+// sm.mu.
+func (sm *ServerManager) clientView(client *Client) protocol.ClientView {
+	return protocol.ClientView{
+		ID:            client.ID,
+		Domain:        sm.domain(client.Subdomain),
+		Port:          client.Port,
+		Ports:         client.Ports,
+		Host:          cmp.Or(client.Host, sm.upstreamHost),
+		Scheme:        cmp.Or(client.Scheme, sm.targetScheme),
+		Protocol:      cmp.Or(client.Protocol, "http"),
+		Labels:        client.Labels,
+		Priority:      client.Priority,
+		Wildcard:      client.Wildcard,
+		Sticky:        client.Sticky,
+		Compress:      client.Compress,
+		Options:       client.labelOnlyOptions(),
+		EntryPoints:   sm.entryPoints,
+		TLSEntryPoint: sm.tlsEntryPoint,
+		TTLSeconds:    int(sm.timeout(client).Seconds()),
+		RegisteredAt:  client.RegisteredAt.Format(time.RFC3339),
+		LastHeartbeat: client.LastHeartbeat().Format(time.RFC3339),
+	}
+}
+
+// labelOnlyOptions lists the register options set on c that devrp export
+// can't turn into compose labels, by their register request names.
+func (c *Client) labelOnlyOptions() []string {
+	var options []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"max_request_body", c.MaxRequestBody > 0},
+		{"info_root", c.InfoRoot},
+		{"error_page", c.ErrorPage != ""},
+		{"rate_limit", c.RateLimit != nil},
+		{"basic_auth", c.BasicAuth != ""},
+		{"request_headers", len(c.RequestHeaders) > 0},
+		{"response_headers", len(c.ResponseHeaders) > 0},
+		{"insecure_skip_verify", c.InsecureSkipVerify},
+	} {
+		if o.set {
+			options = append(options, o.name)
+		}
+	}
+	return options
+}
+
+// healthCheckFromEnv returns the service health check HEALTHCHECK_PATH,
+// HEALTHCHECK_INTERVAL and HEALTHCHECK_TIMEOUT configure, or nil without a
+// path.
+func healthCheckFromEnv() *HealthCheck {
+	path := os.Getenv("HEALTHCHECK_PATH")
+	if path == "" {
+		return nil
+	}
+	return &HealthCheck{
+		Path:     path,
+		Interval: cmp.Or(os.Getenv("HEALTHCHECK_INTERVAL"), "10s"),
+		Timeout:  os.Getenv("HEALTHCHECK_TIMEOUT"),
+	}
+}
+
 func main() {
+	setupLogger()
+
 	configDir := os.Getenv("CONFIG_DIR")
 	if configDir == "" {
 		configDir = "/config"
 	}
 
 	if err := os.MkdirAll(configDir, 0755); err != nil {
-		log.Fatalf("Failed to create config directory: %v", err)
+		slog.Error("Failed to create config directory", "path", configDir, "error", err)
+		os.Exit(1)
+	}
+	// Config writes happen in the background, so check up front that they
+	// can succeed rather than failing on the first registration.
+	if err := checkWritable(configDir); err != nil {
+		slog.Error("Config directory is not writable", "path", configDir, "error", err)
+		os.Exit(1)
 	}
 
 	heartbeatTimeout := 30 * time.Second
-	if timeout := os.Getenv("HEARTBEAT_TIMEOUT"); timeout != "" {
-		if d, err := time.ParseDuration(timeout); err == nil {
-			heartbeatTimeout = d
+	if v := os.Getenv("HEARTBEAT_TIMEOUT"); v != "" {
+		d, err := parseHeartbeatTimeout(v)
+		if err != nil {
+			slog.Error("Invalid HEARTBEAT_TIMEOUT", "value", v, "error", err)
+			os.Exit(1)
+		}
+		heartbeatTimeout = d
+	}
+
+	selfURL := os.Getenv("SELF_URL")
+	if selfURL == "" {
+		selfURL = "http://proxy-server:8080"
+	}
+
+	// TARGET_HOST is the preferred name; UPSTREAM_HOST is still honoured.
+	upstreamHost := unbracket(cmp.Or(os.Getenv("TARGET_HOST"), os.Getenv("UPSTREAM_HOST"), "host.docker.internal"))
+	if !validateHost(upstreamHost) {
+		slog.Error("Invalid TARGET_HOST, expected a hostname or IP", "value", upstreamHost)
+		os.Exit(1)
+	}
+	targetScheme := cmp.Or(os.Getenv("TARGET_SCHEME"), "http")
+	if !validateScheme(targetScheme) {
+		slog.Error("Invalid TARGET_SCHEME, expected http or https", "value", targetScheme)
+		os.Exit(1)
+	}
+	slog.Info("Forwarding to target host", "target_host", upstreamHost, "target_scheme", targetScheme)
+
+	domainSuffix := strings.TrimPrefix(cmp.Or(os.Getenv("DOMAIN_SUFFIX"), "localhost"), ".")
+	if len(domainSuffix) > 253 || !validateSubdomain(domainSuffix) {
+		slog.Error("Invalid DOMAIN_SUFFIX, expected a domain like localhost or test", "value", domainSuffix)
+		os.Exit(1)
+	}
+
+	stateFile := os.Getenv("STATE_FILE")
+	if stateFile == "" {
+		stateFile = filepath.Join(configDir, "state.json")
+	}
+
+	manager := NewServerManager(configDir, stateFile, heartbeatTimeout, selfURL, upstreamHost)
+	// The sweep defaults to 5s, or half the timeout when that is shorter.
+	manager.heartbeatCheckInterval = min(5*time.Second, heartbeatTimeout/2)
+	if v := os.Getenv("HEARTBEAT_CHECK_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d >= heartbeatTimeout {
+			slog.Error("Invalid HEARTBEAT_CHECK_INTERVAL, expected a positive duration below HEARTBEAT_TIMEOUT",
+				"value", v, "heartbeat_timeout", heartbeatTimeout.String())
+			os.Exit(1)
+		}
+		manager.heartbeatCheckInterval = d
+	}
+	manager.maxTTL = max(defaultMaxTTL, heartbeatTimeout)
+	if v := os.Getenv("MAX_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Error("Invalid MAX_TTL, expected a positive duration", "value", v)
+			os.Exit(1)
+		}
+		manager.maxTTL = d
+	}
+
+	manager.domainSuffix = domainSuffix
+	manager.configFormat = strings.ToLower(cmp.Or(os.Getenv("CONFIG_FORMAT"), "yaml"))
+	if manager.configFormat != "yaml" && manager.configFormat != "json" {
+		slog.Error("Invalid CONFIG_FORMAT, expected yaml or json", "value", manager.configFormat)
+		os.Exit(1)
+	}
+	backend := strings.ToLower(os.Getenv("PROXY_BACKEND"))
+	generator, err := newConfigGenerator(backend, manager)
+	if err != nil {
+		slog.Error("Invalid PROXY_BACKEND", "error", err)
+		os.Exit(1)
+	}
+	manager.generator = generator
+	switch mode := cmp.Or(os.Getenv("CONFIG_MODE"), "single"); mode {
+	case "single":
+	case "per-client":
+		if _, ok := generator.(perClientGenerator); !ok {
+			slog.Error("CONFIG_MODE=per-client needs a proxy that watches a directory, i.e. PROXY_BACKEND=traefik")
+			os.Exit(1)
+		}
+		manager.perClientConfig = true
+	default:
+		slog.Error("Invalid CONFIG_MODE, expected single or per-client", "value", mode)
+		os.Exit(1)
+	}
+	manager.configFilename = os.Getenv("CONFIG_FILENAME")
+	if name := manager.configFilename; name != "" {
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			slog.Error("Invalid CONFIG_FILENAME, expected a file name within CONFIG_DIR like dynamic.yml", "value", name)
+			os.Exit(1)
+		}
+		if filepath.Join(configDir, name) == filepath.Clean(stateFile) {
+			slog.Error("CONFIG_FILENAME would overwrite the state file", "value", name, "state_file", stateFile)
+			os.Exit(1)
+		}
+	}
+	slog.Info("Writing proxy config", "backend", cmp.Or(backend, "traefik"), "format", manager.configFormat, "dir", configDir)
+	manager.entryPoints = parseList(cmp.Or(os.Getenv("ENTRYPOINTS"), "web"))
+	if len(manager.entryPoints) == 0 {
+		slog.Error("Invalid ENTRYPOINTS, expected a comma-separated list like web,http", "value", os.Getenv("ENTRYPOINTS"))
+		os.Exit(1)
+	}
+	if cmp.Or(backend, "traefik") == "traefik" {
+		slog.Info("Using Traefik entrypoints", "entrypoints", manager.entryPoints)
+	}
+	if v := os.Getenv("PASS_HOST_HEADER"); v != "" {
+		pass, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Error("Invalid PASS_HOST_HEADER, expected true or false", "value", v)
+			os.Exit(1)
+		}
+		manager.passHostHeader = &pass
+	}
+	manager.healthCheck = healthCheckFromEnv()
+	manager.suffixOnCollision = os.Getenv("SUFFIX_ON_COLLISION") == "true"
+	manager.uniquePorts = os.Getenv("UNIQUE_PORTS") == "true"
+	manager.strictUnregister = os.Getenv("STRICT_UNREGISTER") == "true"
+	manager.configDebounce = 200 * time.Millisecond
+	if v := os.Getenv("CONFIG_DEBOUNCE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			manager.configDebounce = d
+		}
+	}
+	if v := os.Getenv("MAX_CLIENTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			manager.maxClients = n
+		}
+	}
+	registerRate, registerBurst := float64(defaultRegisterRate), defaultRegisterBurst
+	if v := os.Getenv("REGISTER_RATE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+			registerRate = f
+		}
+	}
+	if v := os.Getenv("REGISTER_BURST"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 {
+			registerBurst = n
+		}
+	}
+	if registerRate > 0 {
+		manager.registerLimiter = newIPLimiter(registerRate, registerBurst)
+	}
+	manager.wsMaxConnections = defaultWSMaxConnections
+	if v := os.Getenv("WS_MAX_CONNECTIONS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			manager.wsMaxConnections = n
 		}
 	}
+	manager.reserved = parseReserved(defaultReservedSubdomains)
+	if v, ok := os.LookupEnv("RESERVED_SUBDOMAINS"); ok {
+		manager.reserved = parseReserved(v)
+	}
+	manager.subdomainPrefix = strings.ToLower(os.Getenv("SUBDOMAIN_PREFIX"))
+	if p := manager.subdomainPrefix; p != "" {
+		if strings.Contains(p, ".") || !validateSubdomain(p+"a") {
+			slog.Error("Invalid SUBDOMAIN_PREFIX, expected the start of a DNS label like alice-", "value", p)
+			os.Exit(1)
+		}
+		slog.Info("Prefixing registered subdomains", "subdomain_prefix", p)
+	}
+	manager.targetScheme = targetScheme
+	manager.tlsEntryPoint = os.Getenv("TLS_ENTRYPOINT")
+	manager.tokens.current = []byte(os.Getenv("MGMT_TOKEN"))
+	manager.tokenOverlap = time.Minute
+	if overlap := os.Getenv("TOKEN_ROTATION_OVERLAP"); overlap != "" {
+		if d, err := time.ParseDuration(overlap); err == nil {
+			manager.tokenOverlap = d
+		}
+	}
+
+	if os.Getenv("PROBE_ON_REGISTER") == "true" {
+		manager.probeTimeout = 2 * time.Second
+		if timeout := os.Getenv("PROBE_TIMEOUT"); timeout != "" {
+			if d, err := time.ParseDuration(timeout); err == nil && d > 0 {
+				manager.probeTimeout = d
+			}
+		}
+	}
+
+	// BIND_ADDR, e.g. 127.0.0.1:8080, takes precedence over PORT, which
+	// listens on all interfaces.
+	bindAddr := os.Getenv("BIND_ADDR")
+	if bindAddr == "" {
+		bindAddr = ":" + cmp.Or(os.Getenv("PORT"), "8080")
+	}
+	if !validateBindAddr(bindAddr) {
+		slog.Error("Invalid BIND_ADDR or PORT, expected host:port like 127.0.0.1:8080", "value", bindAddr)
+		os.Exit(1)
+	}
+
+	http.HandleFunc("/register", manager.requireToken(manager.registerLimiter.limit(manager.handleRegister)))
+	http.HandleFunc("/heartbeat", manager.requireToken(manager.handleHeartbeat))
+	http.HandleFunc("/unregister", manager.requireToken(manager.handleUnregister))
+	http.HandleFunc("/status", manager.requireToken(manager.getStatus))
+	http.HandleFunc("/clients", manager.requireToken(manager.getClients))
+	http.HandleFunc("/clients/", manager.requireToken(manager.handleClient))
+	http.HandleFunc("/metrics", manager.requireToken(manager.handleMetrics))
+	http.HandleFunc("/events", manager.requireToken(manager.handleEvents))
+	http.HandleFunc("/ws", manager.requireToken(manager.handleWebSocket))
+	http.HandleFunc("/admin/rotate-token", manager.requireToken(manager.handleRotateToken))
+	http.HandleFunc("/info/", manager.handleInfo)
+	http.HandleFunc("/healthz", manager.handleHealthz)
+	http.HandleFunc("/readyz", manager.handleReadyz)
+	http.HandleFunc("/error-page/", manager.handleErrorPage)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go manager.checkHeartbeats(ctx)
+	if manager.registerLimiter != nil {
+		go manager.registerLimiter.run(ctx)
+	}
 
-	manager := NewServerManager(configDir, heartbeatTimeout)
+	// Write the config right away, even without clients, so /readyz turns
+	// ready and routes left over from a previous run are dropped.
+	manager.scheduleConfig()
 
-	http.HandleFunc("/register", manager.handleRegister)
-	http.HandleFunc("/heartbeat", manager.handleHeartbeat)
-	http.HandleFunc("/unregister", manager.handleUnregister)
-	http.HandleFunc("/status", manager.getStatus)
-	http.HandleFunc("/clients", manager.getClients)
+	writerDone := make(chan struct{})
+	go func() {
+		manager.runConfigWriter(ctx)
+		close(writerDone)
+	}()
 
-	go manager.checkHeartbeats()
+	if os.Getenv("RESOLVE_UPSTREAM") == "true" {
+		go manager.resolveUpstream(ctx)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	handler := recoverPanics(http.DefaultServeMux)
+	if v := os.Getenv("CORS_ORIGINS"); v != "" {
+		handler = cors(parseCORSOrigins(v), handler)
 	}
+	srv := &http.Server{Addr: bindAddr, Handler: accessLog(handler)}
+	srv.RegisterOnShutdown(manager.events.close)
 
 	go func() {
-		log.Printf("Server starting on :%s (heartbeat timeout: %v)", port, heartbeatTimeout)
-		if err := http.ListenAndServe(":"+port, nil); err != nil {
-			log.Fatalf("Server failed: %v", err)
+		slog.Info("Server starting", "addr", srv.Addr, "heartbeat_timeout", heartbeatTimeout.String(), "version", version, "commit", commit)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
 		}
 	}()
 
@@ -373,5 +1562,18 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
-	log.Println("Shutting down...")
+	slog.Info("Shutting down...")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+
+	err = srv.Shutdown(shutdownCtx)
+	cancel()
+	<-writerDone
+
+	if err != nil {
+		slog.Error("Shutdown did not complete", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Shutdown complete")
 }
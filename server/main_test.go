@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestManager returns a manager configured like main's defaults, with
+// its config and state in a temporary directory.
+func newTestManager(t testing.TB) *ServerManager {
+	t.Helper()
+	return newTestManagerIn(t.TempDir())
+}
+
+// newTestManagerIn is newTestManager with config and state in dir, loading
+// any state a previous manager saved there.
+func newTestManagerIn(dir string) *ServerManager {
+	sm := NewServerManager(dir, filepath.Join(dir, "state.json"), 30*time.Second, "http://proxy-server:8080", "host.docker.internal")
+	sm.generator = traefikGenerator{sm}
+	sm.configFormat = "yaml"
+	sm.domainSuffix = "localhost"
+	sm.entryPoints = []string{"web"}
+	sm.maxTTL = defaultMaxTTL
+	sm.reserved = parseReserved(defaultReservedSubdomains)
+	sm.targetScheme = "http"
+	return sm
+}
+
+// clientList returns the registered clients sorted by ID, as generateConfig
+// passes them to the generator.
+func clientList(sm *ServerManager) []*Client {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return slices.SortedFunc(maps.Values(sm.clients), func(a, b *Client) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
+
+// generateYAML renders the registered clients with the manager's generator
+// and decodes the YAML generically, so tests see the keys Traefik reads.
+func generateYAML(t testing.TB, sm *ServerManager) map[string]any {
+	t.Helper()
+	data, _, err := sm.generator.Generate(clientList(sm))
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	var config map[string]any
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatalf("decoding generated config: %v\n%s", err, data)
+	}
+	return config
+}
+
+// lookup walks nested maps along keys, returning nil where a key is missing.
+func lookup(v any, keys ...string) any {
+	for _, key := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// register posts body to /register and returns the status code and response.
+func register(t testing.TB, sm *ServerManager, body string) (int, protocol.RegisterResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	sm.handleRegister(rec, httptest.NewRequest(http.MethodPost, "/register", bytes.NewBufferString(body)))
+	var resp protocol.RegisterResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding register response: %v", err)
+	}
+	return rec.Code, resp
+}
+
+// heartbeat posts an unsigned heartbeat and returns the status code.
+func heartbeat(sm *ServerManager, id, token string) int {
+	rec := httptest.NewRecorder()
+	target := "/heartbeat?id=" + url.QueryEscape(id) + "&token=" + url.QueryEscape(token)
+	sm.handleHeartbeat(rec, httptest.NewRequest(http.MethodPost, target, nil))
+	return rec.Code
+}
+
+func TestHeartbeatAfterRemoval(t *testing.T) {
+	sm := newTestManager(t)
+	code, resp := register(t, sm, `{"id": "myapp", "port": 3000}`)
+	if code != http.StatusOK {
+		t.Fatalf("register: got %d: %s", code, resp.Message)
+	}
+	if got := heartbeat(sm, "myapp", resp.Token); got != http.StatusOK {
+		t.Fatalf("heartbeat: got %d, want 200", got)
+	}
+
+	sm.mu.Lock()
+	delete(sm.clients, toInternalID("myapp"))
+	sm.mu.Unlock()
+
+	if got := heartbeat(sm, "myapp", resp.Token); got != http.StatusNotFound {
+		t.Fatalf("heartbeat after removal: got %d, want 404", got)
+	}
+}
+
+// touchClientWriteLocked is the heartbeat path before touchClient: the
+// lookup and touch under the write lock. It is the benchmark baseline.
+func (sm *ServerManager) touchClientWriteLocked(id string, now time.Time) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	client, ok := sm.clients[id]
+	if ok {
+		client.touch(now)
+	}
+	return ok
+}
+
+// BenchmarkHeartbeat runs parallel heartbeats through the handler, and
+// compares touchClient with the write-locked baseline, both idle and while
+// registrations and config generations take the write lock.
+func BenchmarkHeartbeat(b *testing.B) {
+	b.Run("handler", func(b *testing.B) {
+		sm := newTestManager(b)
+		code, resp := register(b, sm, `{"id": "myapp", "port": 3000}`)
+		if code != http.StatusOK {
+			b.Fatalf("register: got %d: %s", code, resp.Message)
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if got := heartbeat(sm, "myapp", resp.Token); got != http.StatusOK {
+					b.Errorf("heartbeat: got %d, want 200", got)
+					return
+				}
+			}
+		})
+	})
+
+	for _, writers := range []bool{false, true} {
+		for _, locking := range []string{"read-lock", "write-lock"} {
+			name := locking
+			if writers {
+				name += "/writers"
+			}
+			b.Run(name, func(b *testing.B) {
+				sm := newTestManager(b)
+				registerAll(b, sm, `{"id": "myapp", "port": 3000}`)
+				_, other := register(b, sm, `{"id": "other", "port": 3001}`)
+				update := `{"id": "other", "port": 3001, "token": "` + other.Token + `"}`
+				id := toInternalID("myapp")
+				sm.mu.RLock()
+				client := sm.clients[id]
+				sm.mu.RUnlock()
+
+				if writers {
+					stop := make(chan struct{})
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						for {
+							select {
+							case <-stop:
+								return
+							default:
+							}
+							if code, resp := register(b, sm, update); code != http.StatusOK {
+								b.Errorf("update: got %d: %s", code, resp.Message)
+								return
+							}
+							sm.generateConfig()
+						}
+					}()
+					b.Cleanup(func() {
+						close(stop)
+						<-done
+					})
+				}
+
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						now := time.Now()
+						ok := false
+						if locking == "read-lock" {
+							ok = sm.touchClient(id, client, now)
+						} else {
+							ok = sm.touchClientWriteLocked(id, now)
+						}
+						if !ok {
+							b.Error("client not registered")
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestErrorPageRequiresBuiltin(t *testing.T) {
+	sm := newTestManager(t)
+	register(t, sm, `{"id": "plain", "port": 3000}`)
+	register(t, sm, `{"id": "pretty", "port": 3001, "error_page": "builtin"}`)
+
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{"plain", http.StatusNotFound},
+		{"pretty", http.StatusBadGateway},
+		{"missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		sm.handleErrorPage(rec, httptest.NewRequest(http.MethodGet, "/error-page/"+toInternalID(tt.id)+"/502", nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.id, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestRegisterIsCaseInsensitive(t *testing.T) {
+	sm := newTestManager(t)
+	code, resp := register(t, sm, `{"id": "Foo", "port": 3000}`)
+	if code != http.StatusOK {
+		t.Fatalf("register Foo: got %d: %s", code, resp.Message)
+	}
+	if resp.Subdomain != "foo" {
+		t.Errorf("subdomain = %q, want foo", resp.Subdomain)
+	}
+	if code, resp := register(t, sm, `{"id": "foo", "port": 3001}`); code != http.StatusConflict {
+		t.Fatalf("register foo: got %d (%s), want 409", code, resp.Message)
+	}
+}
+
+func TestStaleTakeoverIsRegistration(t *testing.T) {
+	sm := newTestManager(t)
+	events, _ := sm.events.subscribe()
+	_, first := register(t, sm, `{"id": "myapp", "port": 3000}`)
+	<-events
+
+	code, resp := register(t, sm, `{"id": "myapp", "port": 3001, "token": "`+first.Token+`"}`)
+	if code != http.StatusOK || resp.Status != "updated" {
+		t.Fatalf("owner re-register: got %d %q, want 200 updated", code, resp.Status)
+	}
+	if e := <-events; e.name != "update" {
+		t.Errorf("owner re-register published %q, want update", e.name)
+	}
+
+	clientList(sm)[0].touch(time.Now().Add(-time.Minute))
+	code, resp = register(t, sm, `{"id": "myapp", "port": 3002}`)
+	if code != http.StatusOK || resp.Status != "registered" {
+		t.Fatalf("takeover: got %d %q, want 200 registered", code, resp.Status)
+	}
+	if e := <-events; e.name != "register" {
+		t.Errorf("takeover published %q, want register", e.name)
+	}
+}
+
+func TestRegisterRejectsTraefikOnlyOptions(t *testing.T) {
+	options := map[string]string{
+		"basic_auth":       `"basic_auth": {"user": "demo", "password": "secret"}`,
+		"rate_limit":       `"rate_limit": {"average": 10, "burst": 20}`,
+		"request_headers":  `"request_headers": {"X-Debug": "1"}`,
+		"response_headers": `"response_headers": {"X-Debug": "1"}`,
+		"error_page":       `"error_page": "builtin"`,
+		"info_root":        `"info_root": true`,
+		"priority":         `"priority": 10`,
+		"sticky":           `"sticky": true`,
+		"compress":         `"compress": true`,
+	}
+	for _, backend := range []string{"caddy", "nginx"} {
+		for name, field := range options {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				sm := newTestManager(t)
+				generator, err := newConfigGenerator(backend, sm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sm.generator = generator
+				code, resp := register(t, sm, `{"id": "myapp", "port": 3000, `+field+`}`)
+				if code != http.StatusBadRequest || resp.Message != name+" requires the traefik backend" {
+					t.Errorf("got %d %q, want 400 for %s", code, resp.Message, name)
+				}
+			})
+		}
+	}
+
+	sm := newTestManager(t)
+	if code, resp := register(t, sm, `{"id": "myapp", "port": 3000, "info_root": true, "sticky": true}`); code != http.StatusOK {
+		t.Errorf("traefik backend: got %d: %s", code, resp.Message)
+	}
+}
+
+func TestClientViewKeys(t *testing.T) {
+	sm := newTestManager(t)
+	sm.tlsEntryPoint = "websecure"
+	registerAll(t, sm,
+		`{"id": "minimal", "port": 3000}`,
+		`{"id": "full", "port": 3001, "labels": {"team": "web"}, "priority": 5,
+			"wildcard": true, "sticky": true, "compress": true, "info_root": true}`,
+	)
+
+	rec := httptest.NewRecorder()
+	sm.getClients(rec, httptest.NewRequest(http.MethodGet, "/clients", nil))
+	var body struct {
+		Clients []map[string]json.RawMessage `json:"clients"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	always := []string{
+		"id", "domain", "port", "ports", "host", "scheme", "protocol",
+		"entrypoints", "tls_entrypoint", "ttl_seconds", "registered_at", "last_heartbeat",
+	}
+	want := map[string][]string{
+		"minimal": always,
+		"full":    append(slices.Clone(always), "labels", "priority", "wildcard", "sticky", "compress", "options"),
+	}
+	if len(body.Clients) != len(want) {
+		t.Fatalf("got %d clients, want %d", len(body.Clients), len(want))
+	}
+	for _, view := range body.Clients {
+		var id string
+		json.Unmarshal(view["id"], &id)
+		got := slices.Sorted(maps.Keys(view))
+		if w := slices.Sorted(slices.Values(want[id])); !slices.Equal(got, w) {
+			t.Errorf("%s keys = %v, want %v", id, got, w)
+		}
+	}
+}
+
+func TestExpireClientsPerTTL(t *testing.T) {
+	sm := newTestManager(t)
+	registerAll(t, sm,
+		`{"id": "short", "port": 3000, "ttl_seconds": 10}`,
+		`{"id": "long", "port": 3001, "ttl_seconds": 60}`,
+		`{"id": "default", "port": 3002}`,
+	)
+	start := time.Now()
+	for _, client := range clientList(sm) {
+		client.touch(start)
+	}
+
+	steps := []struct {
+		after time.Duration
+		want  []string
+	}{
+		{5 * time.Second, nil},
+		{11 * time.Second, []string{"short"}},
+		{31 * time.Second, []string{"default"}},
+		{59 * time.Second, nil},
+		{61 * time.Second, []string{"long"}},
+	}
+	for _, step := range steps {
+		var got []string
+		for _, client := range sm.expireClients(start.Add(step.after)) {
+			got = append(got, client.ID)
+		}
+		if !slices.Equal(got, step.want) {
+			t.Errorf("after %v: expired %v, want %v", step.after, got, step.want)
+		}
+	}
+	if n := len(clientList(sm)); n != 0 {
+		t.Errorf("%d clients left, want 0", n)
+	}
+}
+
+// failingGenerator fails every generation, in both config modes.
+type failingGenerator struct{}
+
+var errGenerate = errors.New("generate failed")
+
+func (failingGenerator) Generate([]*Client) ([]byte, string, error) {
+	return nil, "", errGenerate
+}
+
+func (failingGenerator) GeneratePerClient([]*Client) ([]byte, string, map[string][]byte, error) {
+	return nil, "", nil, errGenerate
+}
+
+func TestGenerateConfigError(t *testing.T) {
+	for _, perClient := range []bool{false, true} {
+		sm := newTestManager(t)
+		registerAll(t, sm, `{"id": "myapp", "port": 3000}`)
+		sm.generator = failingGenerator{}
+		sm.perClientConfig = perClient
+
+		sm.generateConfig()
+		if !errors.Is(sm.lastGenerateError, errGenerate) {
+			t.Errorf("perClient=%t: recorded error %v, want %v", perClient, sm.lastGenerateError, errGenerate)
+		}
+		if entries, _ := os.ReadDir(sm.configDir); len(entries) != 0 {
+			t.Errorf("perClient=%t: files written despite the error: %v", perClient, entries)
+		}
+	}
+}
+
+func TestInfoRequiresInfoRoot(t *testing.T) {
+	sm := newTestManager(t)
+	registerAll(t, sm,
+		`{"id": "plain", "port": 3000}`,
+		`{"id": "docs", "port": 3001, "info_root": true}`,
+	)
+	tests := map[string]int{
+		"plain":   http.StatusNotFound,
+		"docs":    http.StatusOK,
+		"missing": http.StatusNotFound,
+	}
+	for id, want := range tests {
+		rec := httptest.NewRecorder()
+		sm.handleInfo(rec, httptest.NewRequest(http.MethodGet, "/info/"+toInternalID(id), nil))
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", id, rec.Code, want)
+		}
+	}
+}
+
+func TestInfoRouterNameIsUnique(t *testing.T) {
+	sm := newTestManager(t)
+	registerAll(t, sm,
+		`{"id": "foo", "port": 3000, "info_root": true}`,
+		`{"id": "foo-info", "port": 3001}`,
+	)
+	routers := lookup(generateYAML(t, sm), "http", "routers").(map[string]any)
+	if len(routers) != 3 {
+		t.Fatalf("got routers %v, want foo's two and foo-info's", slices.Sorted(maps.Keys(routers)))
+	}
+	if got := lookup(routers, "sub-foo-info", "service"); got != "local-foo-info" {
+		t.Errorf("sub-foo-info routes to %v, want local-foo-info", got)
+	}
+}
+
+func TestSuffixOnCollisionNames(t *testing.T) {
+	sm := newTestManager(t)
+	sm.suffixOnCollision = true
+	registerAll(t, sm, `{"id": "myapp", "port": 3000, "ports": [
+		{"path": "/api", "port": 4000}, {"path": "/ws", "port": 5000}]}`)
+	code, resp := register(t, sm, `{"id": "myapp", "port": 3001}`)
+	if code != http.StatusOK || resp.Subdomain != "myapp-2" {
+		t.Fatalf("colliding register: got %d %q, want 200 myapp-2", code, resp.Subdomain)
+	}
+
+	routers := lookup(generateYAML(t, sm), "http", "routers").(map[string]any)
+	if len(routers) != 4 {
+		t.Fatalf("got routers %v, want myapp's three and myapp-2's", slices.Sorted(maps.Keys(routers)))
+	}
+	if got := lookup(routers, "sub-myapp-2", "service"); got != "local-myapp-2" {
+		t.Errorf("sub-myapp-2 routes to %v, want local-myapp-2", got)
+	}
+}
+
+func TestSubdomainPrefixAlwaysPrepended(t *testing.T) {
+	sm := newTestManager(t)
+	sm.subdomainPrefix = "dev"
+	code, resp := register(t, sm, `{"id": "devtools", "port": 3000}`)
+	if code != http.StatusOK {
+		t.Fatalf("register: got %d: %s", code, resp.Message)
+	}
+	if resp.URL != "http://devdevtools.localhost" || resp.Subdomain != "devtools" {
+		t.Errorf("got url %q subdomain %q, want the prefixed url and the registered name", resp.URL, resp.Subdomain)
+	}
+	_, tools := register(t, sm, `{"id": "tools", "port": 3001}`)
+
+	// The registered name and the prefixed one both reach devtools; the
+	// prefixed form of tools loses to the registered name devtools.
+	for _, id := range []string{"devtools", "devdevtools"} {
+		if got := heartbeat(sm, id, resp.Token); got != http.StatusOK {
+			t.Errorf("heartbeat as %s: got %d, want 200", id, got)
+		}
+	}
+	if got := heartbeat(sm, "tools", tools.Token); got != http.StatusOK {
+		t.Errorf("heartbeat as tools: got %d, want 200", got)
+	}
+}
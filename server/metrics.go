@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics holds the counters served on /metrics in the Prometheus text
+// exposition format.
+type metrics struct {
+	registrations   atomic.Uint64
+	unregistrations atomic.Uint64
+	expirations     atomic.Uint64
+	configWrites    atomic.Uint64
+}
+
+// handleMetrics serves the counters and the active client gauge.
+func (sm *ServerManager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	sm.mu.RLock()
+	active := len(sm.clients)
+	sm.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "devrp_registrations_total", "counter", "Successful registrations, including updates.", sm.metrics.registrations.Load())
+	writeMetric(w, "devrp_unregistrations_total", "counter", "Clients removed through /unregister.", sm.metrics.unregistrations.Load())
+	writeMetric(w, "devrp_expired_clients_total", "counter", "Clients removed after missing heartbeats.", sm.metrics.expirations.Load())
+	writeMetric(w, "devrp_config_writes_total", "counter", "Traefik config files written.", sm.metrics.configWrites.Load())
+	writeMetric(w, "devrp_active_clients", "gauge", "Currently registered clients.", uint64(active))
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
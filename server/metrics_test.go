@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the samples /metrics serves, by metric name.
+func scrape(t *testing.T, sm *ServerManager) map[string]uint64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	sm.handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	samples := make(map[string]uint64)
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(sc.Text(), " ")
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q", sc.Text())
+		}
+		samples[name] = n
+	}
+	return samples
+}
+
+func TestMetricsRegisterUnregister(t *testing.T) {
+	sm := newTestManager(t)
+	before := scrape(t, sm)
+
+	_, resp := register(t, sm, `{"id": "myapp", "port": 3000}`)
+	sm.generateConfig()
+	registered := scrape(t, sm)
+
+	rec := httptest.NewRecorder()
+	target := "/unregister?id=myapp&token=" + url.QueryEscape(resp.Token)
+	sm.handleUnregister(rec, httptest.NewRequest(http.MethodPost, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unregister: got %d: %s", rec.Code, rec.Body)
+	}
+	sm.generateConfig()
+	after := scrape(t, sm)
+
+	deltas := []struct {
+		name     string
+		from, to map[string]uint64
+		want     uint64
+	}{
+		{"devrp_registrations_total", before, registered, 1},
+		{"devrp_config_writes_total", before, registered, 1},
+		{"devrp_active_clients", before, registered, 1},
+		{"devrp_unregistrations_total", registered, after, 1},
+		{"devrp_config_writes_total", registered, after, 1},
+		{"devrp_registrations_total", registered, after, 0},
+		{"devrp_expired_clients_total", before, after, 0},
+	}
+	for _, d := range deltas {
+		if got := d.to[d.name] - d.from[d.name]; got != d.want {
+			t.Errorf("%s went up by %d, want %d", d.name, got, d.want)
+		}
+	}
+	if got := after["devrp_active_clients"]; got != 0 {
+		t.Errorf("devrp_active_clients = %d after unregister, want 0", got)
+	}
+}
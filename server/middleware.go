@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// requestIDRegex matches request IDs accepted from an incoming X-Request-Id,
+// e.g. one set by a proxy in front of the server.
+var requestIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// statusCapturingResponseWriter records the status code written through it.
+// It forwards Flush and Hijack, which /events and /ws rely on.
+type statusCapturingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusCapturingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusCapturingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusCapturingResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusCapturingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *statusCapturingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessLog assigns every request an ID, echoed in X-Request-Id, and logs it
+// once it completes. Successful requests are logged at debug level since
+// heartbeats alone would flood the log, client errors at info and server
+// errors at warn.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDRegex.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		start := time.Now()
+		sw := &statusCapturingResponseWriter{ResponseWriter: w}
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := slog.LevelDebug
+			switch {
+			case status >= 500:
+				level = slog.LevelWarn
+			case status >= 400:
+				level = slog.LevelInfo
+			}
+			slog.Log(r.Context(), level, "Request", "event", "request", "request_id", id,
+				"method", r.Method, "path", r.URL.Path, "status", status, "duration", time.Since(start))
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// recoverPanics turns a panicking handler into a logged stack trace and a
+// JSON 500, instead of a dropped connection. If the handler already started
+// its response, the connection is closed instead.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusCapturingResponseWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// ErrAbortHandler is how handlers abort a response on purpose;
+			// net/http handles it quietly.
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			slog.Error("Handler panicked", "request_id", w.Header().Get("X-Request-Id"),
+				"method", r.Method, "path", r.URL.Path, "panic", err, "stack", string(debug.Stack()))
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "error",
+				"message": "internal error",
+			})
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// corsOrigins is the parsed CORS_ORIGINS setting: "*" allows any origin,
+// otherwise only the listed ones.
+type corsOrigins struct {
+	any     bool
+	allowed map[string]bool
+}
+
+// parseCORSOrigins parses a comma-separated origin list like
+// "http://localhost:5173,https://dash.example.com", or "*".
+func parseCORSOrigins(list string) corsOrigins {
+	origins := corsOrigins{allowed: make(map[string]bool)}
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			origins.any = true
+		default:
+			origins.allowed[origin] = true
+		}
+	}
+	return origins
+}
+
+// cors adds CORS headers for allowed origins and answers their preflight
+// requests, which carry no Authorization header and so must not reach
+// requireToken.
+func cors(origins corsOrigins, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !origins.any && !origins.allowed[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if origins.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	mux.HandleFunc("/panic-after-write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("boom")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	srv := httptest.NewServer(accessLog(recoverPanics(mux)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || body["status"] != "error" {
+		t.Errorf("panicking handler: got %d %v, want 500 with a JSON error", resp.StatusCode, body)
+	}
+
+	// A response already under way can't become a 500, so the connection is
+	// dropped instead.
+	if resp, err := http.Get(srv.URL + "/panic-after-write"); err == nil {
+		resp.Body.Close()
+	}
+
+	for range 2 {
+		resp, err := http.Get(srv.URL + "/ok")
+		if err != nil {
+			t.Fatalf("server stopped serving after a panic: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("after a panic: got %d, want 200", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// nginxReloadTimeout bounds NGINX_RELOAD_CMD.
+const nginxReloadTimeout = 10 * time.Second
+
+// nginxGenerator renders an nginx config snippet, meant to be included in the
+// http block, with one server block per client and a location per port
+// mapping. nginx picks the longest matching location prefix by itself.
+type nginxGenerator struct {
+	sm     *ServerManager
+	listen string
+	// reloadCmd is run through sh after every write, e.g. "nginx -s reload".
+	reloadCmd string
+}
+
+func (g nginxGenerator) Generate(clients []*Client) ([]byte, string, error) {
+	var b strings.Builder
+	b.WriteString("# Generated by dev-reverse-proxy. Do not edit.\n")
+
+	for _, client := range clients {
+		fmt.Fprintf(&b, "\nserver {\n")
+		fmt.Fprintf(&b, "    listen %s;\n", g.listen)
+		// nginx prefers exact names over wildcards, so subdomains registered
+		// on their own still win.
+		if client.Wildcard {
+			fmt.Fprintf(&b, "    server_name %s *.%[1]s;\n", g.sm.domain(client.Subdomain))
+		} else {
+			fmt.Fprintf(&b, "    server_name %s;\n", g.sm.domain(client.Subdomain))
+		}
+		if client.MaxRequestBody > 0 {
+			fmt.Fprintf(&b, "    client_max_body_size %d;\n", client.MaxRequestBody)
+		}
+
+		for _, m := range client.Ports {
+			fmt.Fprintf(&b, "\n    location %s {\n", m.Path)
+			fmt.Fprintf(&b, "        proxy_pass %s;\n", client.serviceURL(g.sm.targetScheme, g.sm.upstreamHost, m.Port))
+			b.WriteString("        proxy_http_version 1.1;\n")
+			b.WriteString("        proxy_set_header Host $host;\n")
+			b.WriteString("        proxy_set_header Upgrade $http_upgrade;\n")
+			b.WriteString("        proxy_set_header Connection \"upgrade\";\n")
+			b.WriteString("        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;\n")
+			b.WriteString("        proxy_set_header X-Forwarded-Proto $scheme;\n")
+			b.WriteString("    }\n")
+		}
+		b.WriteString("}\n")
+	}
+
+	return []byte(b.String()), "nginx.conf", nil
+}
+
+// Reload runs the configured reload command, if any.
+func (g nginxGenerator) Reload() error {
+	if g.reloadCmd == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nginxReloadTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "sh", "-c", g.reloadCmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", g.reloadCmd, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRegisterRate and defaultRegisterBurst limit /register per
+	// source IP unless REGISTER_RATE and REGISTER_BURST are set. They are
+	// far above what a client restarting by hand needs, but stop one stuck
+	// in a crash loop.
+	defaultRegisterRate  = 5
+	defaultRegisterBurst = 20
+
+	// limiterCleanupInterval is how often buckets that have filled up
+	// again are dropped.
+	limiterCleanupInterval = time.Minute
+)
+
+// ipLimiter is a token bucket per source IP: each IP may make burst
+// requests at once, refilled at rate per second.
+type ipLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPLimiter(rate float64, burst int) *ipLimiter {
+	return &ipLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from ip's bucket. If it is empty, allow returns false
+// and how long until the next token.
+func (l *ipLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup drops buckets that have refilled completely, which are no
+// different from a new one, so the map only holds recently active IPs.
+func (l *ipLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// run cleans up the buckets periodically until ctx is done.
+func (l *ipLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(limiterCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.cleanup(now)
+		}
+	}
+}
+
+// limit answers 429 with a Retry-After header once the requesting IP has
+// used up its bucket. A nil limiter lets everything through.
+func (l *ipLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if ok, wait := l.allow(ip, time.Now()); !ok {
+			slog.Debug("Registration rate limited", "event", "register_rate_limited", "ip", ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeRegisterError(w, http.StatusTooManyRequests, "too many registrations, slow down")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+// clientState is the persisted form of a Client.
+type clientState struct {
+	ID                 string                 `json:"id"`
+	Subdomain          string                 `json:"subdomain"`
+	Port               int                    `json:"port"`
+	Ports              []protocol.PortMapping `json:"ports"`
+	Host               string                 `json:"host,omitempty"`
+	Scheme             string                 `json:"scheme,omitempty"`
+	BasicAuth          string                 `json:"basic_auth,omitempty"`
+	RequestHeaders     map[string]string      `json:"request_headers,omitempty"`
+	ResponseHeaders    map[string]string      `json:"response_headers,omitempty"`
+	InsecureSkipVerify bool                   `json:"insecure_skip_verify,omitempty"`
+	Protocol           string                 `json:"protocol,omitempty"`
+	MaxRequestBody     int64                  `json:"max_request_body,omitempty"`
+	InfoRoot           bool                   `json:"info_root,omitempty"`
+	ErrorPage          string                 `json:"error_page,omitempty"`
+	RateLimit          *protocol.RateLimit    `json:"rate_limit,omitempty"`
+	Token              string                 `json:"token"`
+	HeartbeatSecret    string                 `json:"heartbeat_secret,omitempty"`
+	Labels             map[string]string      `json:"labels,omitempty"`
+	Priority           int                    `json:"priority,omitempty"`
+	TTLSeconds         int                    `json:"ttl_seconds,omitempty"`
+	Wildcard           bool                   `json:"wildcard,omitempty"`
+	Sticky             bool                   `json:"sticky,omitempty"`
+	Compress           bool                   `json:"compress,omitempty"`
+	RegisteredAt       time.Time              `json:"registered_at"`
+	LastHeartbeat      time.Time              `json:"last_heartbeat"`
+}
+
+type serverState struct {
+	// SavedAt is when the snapshot was taken. State is only saved on
+	// changes, so a client's last_heartbeat lags behind the heartbeats it
+	// kept sending until then.
+	SavedAt time.Time     `json:"saved_at"`
+	Clients []clientState `json:"clients"`
+}
+
+// saveState snapshots the registered clients to the state file.
+func (sm *ServerManager) saveState() {
+	if sm.stateFile == "" {
+		return
+	}
+
+	sm.mu.RLock()
+	state := serverState{SavedAt: time.Now(), Clients: make([]clientState, 0, len(sm.clients))}
+	for _, client := range sm.clients {
+		state.Clients = append(state.Clients, clientState{
+			ID:                 client.ID,
+			Subdomain:          client.Subdomain,
+			Port:               client.Port,
+			Ports:              client.Ports,
+			Host:               client.Host,
+			Scheme:             client.Scheme,
+			BasicAuth:          client.BasicAuth,
+			RequestHeaders:     client.RequestHeaders,
+			ResponseHeaders:    client.ResponseHeaders,
+			InsecureSkipVerify: client.InsecureSkipVerify,
+			Protocol:           client.Protocol,
+			MaxRequestBody:     client.MaxRequestBody,
+			InfoRoot:           client.InfoRoot,
+			ErrorPage:          client.ErrorPage,
+			RateLimit:          client.RateLimit,
+			Token:              client.Token,
+			HeartbeatSecret:    client.HeartbeatSecret,
+			Labels:             client.Labels,
+			Priority:           client.Priority,
+			TTLSeconds:         int(client.TTL / time.Second),
+			Wildcard:           client.Wildcard,
+			Sticky:             client.Sticky,
+			Compress:           client.Compress,
+			RegisteredAt:       client.RegisteredAt,
+			LastHeartbeat:      client.LastHeartbeat(),
+		})
+	}
+	sm.mu.RUnlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		slog.Error("Failed to marshal state", "error", err)
+		return
+	}
+	// The state holds ownership tokens, so keep it private.
+	if err := writeFileAtomic(sm.stateFile, data, 0600); err != nil {
+		slog.Error("Failed to write state", "path", sm.stateFile, "error", err)
+	}
+}
+
+// loadState restores clients from the state file, skipping any whose
+// heartbeat timeout already passed. Clients count as alive when the state was
+// saved, since the expiry sweep would have dropped them otherwise, so the
+// timeout runs from saved_at; state saved before saved_at existed falls back
+// to each client's last heartbeat.
+func (sm *ServerManager) loadState() {
+	if sm.stateFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(sm.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Failed to read state", "path", sm.stateFile, "error", err)
+		return
+	}
+
+	var state serverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Warn("Ignoring invalid state file", "path", sm.stateFile, "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, cs := range state.Clients {
+		ttl := time.Duration(cs.TTLSeconds) * time.Second
+		alive := cs.LastHeartbeat
+		if state.SavedAt.After(alive) {
+			alive = state.SavedAt
+		}
+		if now.Sub(alive) > cmp.Or(ttl, sm.heartbeatTimeout) {
+			continue
+		}
+		// Entries saved before subdomains were lowercased are normalized
+		// here, so they match what heartbeats look up.
+		subdomain := strings.ToLower(cs.Subdomain)
+		client := &Client{
+			ID:                 toInternalID(subdomain),
+			Port:               cs.Port,
+			Ports:              cs.Ports,
+			Subdomain:          subdomain,
+			MaxRequestBody:     cs.MaxRequestBody,
+			InfoRoot:           cs.InfoRoot,
+			ErrorPage:          cs.ErrorPage,
+			Host:               cs.Host,
+			Scheme:             cs.Scheme,
+			BasicAuth:          cs.BasicAuth,
+			RequestHeaders:     cs.RequestHeaders,
+			ResponseHeaders:    cs.ResponseHeaders,
+			InsecureSkipVerify: cs.InsecureSkipVerify,
+			Protocol:           cs.Protocol,
+			RateLimit:          cs.RateLimit,
+			Token:              cs.Token,
+			HeartbeatSecret:    cs.HeartbeatSecret,
+			Labels:             cs.Labels,
+			Priority:           cs.Priority,
+			TTL:                ttl,
+			Wildcard:           cs.Wildcard,
+			Sticky:             cs.Sticky,
+			Compress:           cs.Compress,
+			RegisteredAt:       cs.RegisteredAt,
+		}
+		if len(client.Ports) == 0 {
+			client.Ports = []protocol.PortMapping{{Path: "/", Port: cs.Port}}
+		}
+		// State saved before registered_at existed only knows the last
+		// heartbeat.
+		if client.RegisteredAt.IsZero() {
+			client.RegisteredAt = cs.LastHeartbeat
+		}
+		client.touch(alive)
+		sm.clients[client.ID] = client
+	}
+
+	slog.Info("Restored clients from state", "path", sm.stateFile, "restored", len(sm.clients), "stale", len(state.Clients)-len(sm.clients))
+	if len(sm.clients) > 0 {
+		sm.scheduleConfig()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	sm := newTestManagerIn(dir)
+	for _, body := range []string{
+		`{"id": "first", "port": 3000}`,
+		`{"id": "second", "port": 3001, "ports": [{"path": "/api", "port": 4000}]}`,
+	} {
+		if code, resp := register(t, sm, body); code != http.StatusOK {
+			t.Fatalf("register %s: got %d: %s", body, code, resp.Message)
+		}
+	}
+	sm.saveState()
+
+	restarted := newTestManagerIn(dir)
+	if got := len(clientList(restarted)); got != 2 {
+		t.Fatalf("restored %d clients, want 2", got)
+	}
+	config := generateYAML(t, restarted)
+	for _, router := range []string{"sub-first", "sub-second", "sub-second~1"} {
+		if lookup(config, "http", "routers", router) == nil {
+			t.Errorf("router %s missing after restart", router)
+		}
+	}
+	if got := lookup(config, "http", "services", "local-second~1", "loadBalancer", "servers"); got == nil {
+		t.Errorf("service local-second~1 missing after restart")
+	}
+}
+
+func TestStateStalenessFromSavedAt(t *testing.T) {
+	now := time.Now()
+	// The manager's timeout is 30s; "busy" last heartbeated a minute before
+	// the save, which is all the state records between config changes.
+	tests := map[string]struct {
+		savedAt time.Time
+		want    int
+	}{
+		"saved just now":       {now.Add(-time.Second), 1},
+		"saved before timeout": {now.Add(-time.Minute), 0},
+	}
+	for name, tt := range tests {
+		dir := t.TempDir()
+		data, err := json.Marshal(serverState{
+			SavedAt: tt.savedAt,
+			Clients: []clientState{{
+				ID:            "busy",
+				Subdomain:     "busy",
+				Port:          3000,
+				Token:         "token",
+				RegisteredAt:  now.Add(-time.Hour),
+				LastHeartbeat: tt.savedAt.Add(-time.Minute),
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "state.json"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		sm := newTestManagerIn(dir)
+		clients := clientList(sm)
+		if len(clients) != tt.want {
+			t.Errorf("%s: restored %d clients, want %d", name, len(clients), tt.want)
+			continue
+		}
+		// The restored client gets its timeout from the save, not from the
+		// stale heartbeat, so the next sweep keeps it.
+		if tt.want > 0 {
+			sm.expireClients(now)
+			if len(clientList(sm)) != 1 {
+				t.Errorf("%s: restored client expired on the first sweep", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// selfServiceName is the Traefik service pointing back at this server, used
+// to serve the per-subdomain info and error pages.
+const selfServiceName = "devrp-self"
+
+// insecureTransportName is the shared serversTransport for clients that
+// registered with insecure_skip_verify.
+const insecureTransportName = "insecure-skip-verify"
+
+// infoRootPriority is above any default (rule length based) router priority,
+// so the info router wins over the catch-all router for the same host.
+const infoRootPriority = 100000
+
+// maxClientPriority caps the priority clients may register, keeping their
+// routers below the info router.
+const maxClientPriority = infoRootPriority / 2
+
+type TraefikConfig struct {
+	HTTP struct {
+		Routers           map[string]Router           `json:"routers,omitempty" yaml:"routers,omitempty"`
+		Services          map[string]Service          `json:"services,omitempty" yaml:"services,omitempty"`
+		Middlewares       map[string]Middleware       `json:"middlewares,omitempty" yaml:"middlewares,omitempty"`
+		ServersTransports map[string]ServersTransport `json:"serversTransports,omitempty" yaml:"serversTransports,omitempty"`
+	} `json:"http,omitempty" yaml:"http,omitempty"`
+	TCP *TCPConfig `json:"tcp,omitempty" yaml:"tcp,omitempty"`
+}
+
+// TCPConfig holds the routers of clients registered with protocol tcp,
+// matched by TLS server name.
+type TCPConfig struct {
+	Routers  map[string]TCPRouter  `json:"routers" yaml:"routers"`
+	Services map[string]TCPService `json:"services" yaml:"services"`
+}
+
+type TCPRouter struct {
+	EntryPoints []string      `json:"entryPoints" yaml:"entryPoints"`
+	Rule        string        `json:"rule" yaml:"rule"`
+	Service     string        `json:"service" yaml:"service"`
+	TLS         *TCPRouterTLS `json:"tls" yaml:"tls"`
+}
+
+// TCPRouterTLS terminates TLS in Traefik, or with Passthrough forwards the
+// encrypted stream to an app that does TLS itself.
+type TCPRouterTLS struct {
+	Passthrough bool `json:"passthrough,omitempty" yaml:"passthrough,omitempty"`
+}
+
+type TCPService struct {
+	LoadBalancer TCPLoadBalancer `json:"loadBalancer" yaml:"loadBalancer"`
+}
+
+type TCPLoadBalancer struct {
+	Servers []TCPServer `json:"servers" yaml:"servers"`
+}
+
+type TCPServer struct {
+	Address string `json:"address" yaml:"address"`
+}
+
+type Router struct {
+	EntryPoints []string   `json:"entryPoints" yaml:"entryPoints"`
+	Rule        string     `json:"rule" yaml:"rule"`
+	Service     string     `json:"service" yaml:"service"`
+	Middlewares []string   `json:"middlewares,omitempty" yaml:"middlewares,omitempty"`
+	Priority    int        `json:"priority,omitempty" yaml:"priority,omitempty"`
+	TLS         *RouterTLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// RouterTLS is emitted as `tls: {}`, enabling TLS with Traefik's default
+// certificate.
+type RouterTLS struct{}
+
+type Middleware struct {
+	RateLimit      *protocol.RateLimit `json:"rateLimit,omitempty" yaml:"rateLimit,omitempty"`
+	Buffering      *Buffering          `json:"buffering,omitempty" yaml:"buffering,omitempty"`
+	ReplacePath    *ReplacePath        `json:"replacePath,omitempty" yaml:"replacePath,omitempty"`
+	Errors         *Errors             `json:"errors,omitempty" yaml:"errors,omitempty"`
+	RedirectScheme *RedirectScheme     `json:"redirectScheme,omitempty" yaml:"redirectScheme,omitempty"`
+	BasicAuth      *BasicAuthUsers     `json:"basicAuth,omitempty" yaml:"basicAuth,omitempty"`
+	Headers        *Headers            `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Compress       *Compress           `json:"compress,omitempty" yaml:"compress,omitempty"`
+}
+
+// Compress is Traefik's compress middleware with its defaults, emitted as
+// "compress: {}".
+type Compress struct{}
+
+type Headers struct {
+	CustomRequestHeaders  map[string]string `json:"customRequestHeaders,omitempty" yaml:"customRequestHeaders,omitempty"`
+	CustomResponseHeaders map[string]string `json:"customResponseHeaders,omitempty" yaml:"customResponseHeaders,omitempty"`
+}
+
+// BasicAuthUsers is Traefik's basicAuth middleware with htpasswd lines.
+type BasicAuthUsers struct {
+	Users []string `json:"users" yaml:"users"`
+}
+
+type RedirectScheme struct {
+	Scheme    string `json:"scheme" yaml:"scheme"`
+	Permanent bool   `json:"permanent" yaml:"permanent"`
+}
+
+type Errors struct {
+	Status  []string `json:"status" yaml:"status"`
+	Service string   `json:"service" yaml:"service"`
+	Query   string   `json:"query" yaml:"query"`
+}
+
+type ReplacePath struct {
+	Path string `json:"path" yaml:"path"`
+}
+
+type Buffering struct {
+	MaxRequestBodyBytes int64 `json:"maxRequestBodyBytes" yaml:"maxRequestBodyBytes"`
+}
+
+type Service struct {
+	LoadBalancer LoadBalancer `json:"loadBalancer" yaml:"loadBalancer"`
+}
+
+type LoadBalancer struct {
+	Servers     []Server     `json:"servers" yaml:"servers"`
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+	// PassHostHeader is a pointer so an explicit false is emitted; nil
+	// leaves Traefik's default (true).
+	PassHostHeader *bool `json:"passHostHeader,omitempty" yaml:"passHostHeader,omitempty"`
+	// ServersTransport names an entry of the serversTransports section.
+	ServersTransport string  `json:"serversTransport,omitempty" yaml:"serversTransport,omitempty"`
+	Sticky           *Sticky `json:"sticky,omitempty" yaml:"sticky,omitempty"`
+}
+
+// Sticky enables session affinity. An empty Cookie, emitted as
+// "cookie: {}", uses Traefik's default cookie name and attributes.
+type Sticky struct {
+	Cookie *StickyCookie `json:"cookie" yaml:"cookie"`
+}
+
+type StickyCookie struct{}
+
+type ServersTransport struct {
+	InsecureSkipVerify bool `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+}
+
+// HealthCheck makes Traefik poll a server and stop routing to it while it
+// fails.
+type HealthCheck struct {
+	Path     string `json:"path" yaml:"path"`
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+type Server struct {
+	URL string `json:"url" yaml:"url"`
+}
+
+// traefikGenerator renders a Traefik file provider dynamic config, as YAML
+// or, with CONFIG_FORMAT=json, JSON.
+type traefikGenerator struct {
+	sm *ServerManager
+}
+
+func (g traefikGenerator) Generate(clients []*Client) ([]byte, string, error) {
+	return g.marshal(g.build(clients))
+}
+
+// GeneratePerClient renders each client's routers, services and
+// middlewares on their own, and what several clients may refer to (the
+// HTTPS redirect, this server's own service and the insecure transport)
+// into the shared file. Traefik's file provider merges all files of a
+// directory into one configuration, so references across files resolve.
+func (g traefikGenerator) GeneratePerClient(clients []*Client) ([]byte, string, map[string][]byte, error) {
+	shared := newTraefikConfig()
+	files := make(map[string][]byte, len(clients))
+	for _, client := range clients {
+		config := g.build([]*Client{client})
+		moveShared(&config, &shared)
+		data, name, err := g.marshal(config)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		files[clientConfigPrefix+client.ID+filepath.Ext(name)] = data
+	}
+	data, name, err := g.marshal(shared)
+	return data, name, files, err
+}
+
+// moveShared moves the entries several clients' configs can contain from
+// from to to.
+func moveShared(from, to *TraefikConfig) {
+	if m, ok := from.HTTP.Middlewares[protocol.RedirectMiddlewareName]; ok {
+		to.HTTP.Middlewares[protocol.RedirectMiddlewareName] = m
+		delete(from.HTTP.Middlewares, protocol.RedirectMiddlewareName)
+	}
+	if s, ok := from.HTTP.Services[selfServiceName]; ok {
+		to.HTTP.Services[selfServiceName] = s
+		delete(from.HTTP.Services, selfServiceName)
+	}
+	for name, t := range from.HTTP.ServersTransports {
+		if to.HTTP.ServersTransports == nil {
+			to.HTTP.ServersTransports = make(map[string]ServersTransport)
+		}
+		to.HTTP.ServersTransports[name] = t
+	}
+	from.HTTP.ServersTransports = nil
+}
+
+func newTraefikConfig() TraefikConfig {
+	config := TraefikConfig{}
+	config.HTTP.Routers = make(map[string]Router)
+	config.HTTP.Services = make(map[string]Service)
+	config.HTTP.Middlewares = make(map[string]Middleware)
+	return config
+}
+
+// build returns the Traefik config routing clients.
+func (g traefikGenerator) build(clients []*Client) TraefikConfig {
+	config := newTraefikConfig()
+	needSelf := false
+	needInsecureTransport := false
+
+	// addRouter adds router on the HTTP entrypoints and, with a TLS
+	// entrypoint, a "~secure" copy on it while the HTTP router only
+	// redirects.
+	addRouter := func(name string, router Router) {
+		router.EntryPoints = g.sm.entryPoints
+		if g.sm.tlsEntryPoint == "" {
+			config.HTTP.Routers[name] = router
+			return
+		}
+
+		secure := router
+		secure.EntryPoints = []string{g.sm.tlsEntryPoint}
+		secure.TLS = &RouterTLS{}
+		config.HTTP.Routers[protocol.SecureRouterName(name)] = secure
+
+		router.Middlewares = []string{protocol.RedirectMiddlewareName}
+		config.HTTP.Routers[name] = router
+	}
+
+	for _, client := range clients {
+		subdomain := client.ID
+
+		if client.Protocol == "tcp" {
+			if config.TCP == nil {
+				config.TCP = &TCPConfig{
+					Routers:  make(map[string]TCPRouter),
+					Services: make(map[string]TCPService),
+				}
+			}
+			name := "tcp-" + subdomain
+			config.TCP.Routers[name] = TCPRouter{
+				EntryPoints: []string{g.sm.tlsEntryPoint},
+				Rule:        "HostSNI(`" + g.sm.domain(client.Subdomain) + "`)",
+				Service:     name,
+				TLS:         &TCPRouterTLS{Passthrough: client.Scheme == "https"},
+			}
+			config.TCP.Services[name] = TCPService{
+				LoadBalancer: TCPLoadBalancer{
+					Servers: []TCPServer{{Address: client.upstream(g.sm.upstreamHost, client.Port)}},
+				},
+			}
+			continue
+		}
+
+		var middlewares []string
+		if client.RateLimit != nil {
+			name := "rate-limit-" + subdomain
+			config.HTTP.Middlewares[name] = Middleware{RateLimit: client.RateLimit}
+			middlewares = append(middlewares, name)
+		}
+
+		var authMiddleware []string
+		if client.BasicAuth != "" {
+			name := "basic-auth-" + subdomain
+			config.HTTP.Middlewares[name] = Middleware{
+				BasicAuth: &BasicAuthUsers{Users: []string{client.BasicAuth}},
+			}
+			middlewares = append(middlewares, name)
+			authMiddleware = []string{name}
+		}
+
+		// Compression comes before the remaining middlewares, so it also
+		// covers their responses, e.g. error pages.
+		if client.Compress {
+			name := "compress-" + subdomain
+			config.HTTP.Middlewares[name] = Middleware{Compress: &Compress{}}
+			middlewares = append(middlewares, name)
+		}
+
+		if len(client.RequestHeaders) > 0 || len(client.ResponseHeaders) > 0 {
+			name := "headers-" + subdomain
+			config.HTTP.Middlewares[name] = Middleware{
+				Headers: &Headers{
+					CustomRequestHeaders:  client.RequestHeaders,
+					CustomResponseHeaders: client.ResponseHeaders,
+				},
+			}
+			middlewares = append(middlewares, name)
+		}
+
+		if client.MaxRequestBody > 0 {
+			name := "body-limit-" + subdomain
+			config.HTTP.Middlewares[name] = Middleware{
+				Buffering: &Buffering{MaxRequestBodyBytes: client.MaxRequestBody},
+			}
+			middlewares = append(middlewares, name)
+		}
+
+		if client.ErrorPage != "" {
+			name := "error-page-" + subdomain
+			pages := &Errors{
+				Status:  []string{"500-599"},
+				Service: client.ErrorPage,
+				Query:   "/{status}.html",
+			}
+			if client.ErrorPage == builtinErrorPage {
+				pages.Service = selfServiceName
+				pages.Query = "/error-page/" + subdomain + "/{status}"
+				needSelf = true
+			}
+			config.HTTP.Middlewares[name] = Middleware{Errors: pages}
+			middlewares = append(middlewares, name)
+		}
+
+		domain := g.sm.domain(client.Subdomain)
+		hostRule := "Host(`" + domain + "`)"
+		if client.Wildcard {
+			hostRule = "(" + hostRule + " || HostRegexp(`^.+\\." + regexp.QuoteMeta(domain) + "$`))"
+		}
+		for i, m := range client.Ports {
+			service := protocol.ServiceName(subdomain, i)
+			router := Router{
+				Rule:        hostRule,
+				Service:     service,
+				Middlewares: middlewares,
+				Priority:    protocol.MappingPriority(m, client.Ports, client.Priority, client.Wildcard),
+			}
+			if m.Path != "/" {
+				router.Rule += " && PathPrefix(`" + m.Path + "`)"
+			}
+			addRouter(protocol.RouterName(subdomain, i), router)
+
+			lb := LoadBalancer{
+				Servers: []Server{
+					{URL: client.serviceURL(g.sm.targetScheme, g.sm.upstreamHost, m.Port)},
+				},
+				HealthCheck:    g.sm.healthCheck,
+				PassHostHeader: g.sm.passHostHeader,
+			}
+			if client.Sticky {
+				lb.Sticky = &Sticky{Cookie: &StickyCookie{}}
+			}
+			if client.InsecureSkipVerify {
+				lb.ServersTransport = insecureTransportName
+				needInsecureTransport = true
+			}
+			config.HTTP.Services[service] = Service{LoadBalancer: lb}
+		}
+
+		if client.InfoRoot {
+			infoMiddleware := "info-" + subdomain
+			config.HTTP.Middlewares[infoMiddleware] = Middleware{
+				ReplacePath: &ReplacePath{Path: "/info/" + subdomain},
+			}
+			addRouter(protocol.RouterName(subdomain, 0)+protocol.NameSeparator+"info", Router{
+				Rule:        hostRule + " && Path(`/`)",
+				Service:     selfServiceName,
+				Middlewares: append(authMiddleware, infoMiddleware),
+				Priority:    infoRootPriority,
+			})
+			needSelf = true
+		}
+	}
+
+	if g.sm.tlsEntryPoint != "" && len(config.HTTP.Routers) > 0 {
+		config.HTTP.Middlewares[protocol.RedirectMiddlewareName] = Middleware{
+			RedirectScheme: &RedirectScheme{Scheme: "https"},
+		}
+	}
+
+	if needSelf {
+		config.HTTP.Services[selfServiceName] = Service{
+			LoadBalancer: LoadBalancer{
+				Servers: []Server{{URL: g.sm.selfURL}},
+			},
+		}
+	}
+
+	if needInsecureTransport {
+		config.HTTP.ServersTransports = map[string]ServersTransport{
+			insecureTransportName: {InsecureSkipVerify: true},
+		}
+	}
+	return config
+}
+
+// marshal encodes config as YAML, or JSON with CONFIG_FORMAT=json, and
+// returns the file name. JSON keeps the .yml name: Traefik's file provider
+// skips .json files in its directory, and JSON is valid YAML.
+func (g traefikGenerator) marshal(config TraefikConfig) ([]byte, string, error) {
+	if g.sm.configFormat == "json" {
+		data, err := json.MarshalIndent(config, "", "  ")
+		return data, "dynamic.yml", err
+	}
+	data, err := yaml.Marshal(config)
+	return data, "dynamic.yml", err
+}
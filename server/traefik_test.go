@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// registerAll registers each body, failing the test on any error.
+func registerAll(t testing.TB, sm *ServerManager, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if code, resp := register(t, sm, body); code != http.StatusOK {
+			t.Fatalf("register %s: got %d: %s", body, code, resp.Message)
+		}
+	}
+}
+
+// checkGolden compares the manager's generated config with
+// testdata/<name>, rewriting it with -update.
+func checkGolden(t *testing.T, sm *ServerManager, name string) {
+	t.Helper()
+	data, _, err := sm.generator.Generate(clientList(sm))
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("generated config differs from %s (rerun with -update to accept):\n%s", path, data)
+	}
+}
+
+func TestGenerateTLSRedirect(t *testing.T) {
+	sm := newTestManager(t)
+	sm.tlsEntryPoint = "websecure"
+	registerAll(t, sm,
+		`{"id": "myapp", "port": 3000, "ports": [{"path": "/api", "port": 4000}]}`,
+		`{"id": "docs", "port": 3001, "info_root": true}`,
+	)
+	checkGolden(t, sm, "tls_redirect.yaml")
+
+	config := generateYAML(t, sm)
+	if got := lookup(config, "http", "middlewares", protocol.RedirectMiddlewareName, "redirectScheme", "scheme"); got != "https" {
+		t.Errorf("redirect middleware scheme = %v, want https", got)
+	}
+
+	routers, _ := lookup(config, "http", "routers").(map[string]any)
+	for _, name := range []string{"sub-myapp", "sub-myapp~1", "sub-docs", "sub-docs~info"} {
+		if routers[name] == nil || routers[name+protocol.NameSeparator+"secure"] == nil {
+			t.Errorf("router %s or its ~secure copy missing", name)
+		}
+	}
+	for name, router := range routers {
+		entryPoints, _ := lookup(router, "entryPoints").([]any)
+		middlewares, _ := lookup(router, "middlewares").([]any)
+		if slices.Contains(entryPoints, any("websecure")) {
+			if lookup(router, "tls") == nil {
+				t.Errorf("%s: TLS router without tls", name)
+			}
+			if slices.Contains(middlewares, any(protocol.RedirectMiddlewareName)) {
+				t.Errorf("%s: TLS router redirects", name)
+			}
+			continue
+		}
+		if !slices.Equal(middlewares, []any{protocol.RedirectMiddlewareName}) {
+			t.Errorf("%s: HTTP router middlewares = %v, want only %s", name, middlewares, protocol.RedirectMiddlewareName)
+		}
+	}
+}
+
+func TestGenerateTargetHost(t *testing.T) {
+	sm := newTestManager(t)
+	sm.upstreamHost = "172.17.0.1"
+	registerAll(t, sm,
+		`{"id": "myapp", "port": 3000}`,
+		`{"id": "tunnel", "port": 3001, "host": "10.0.0.5"}`,
+	)
+
+	config := generateYAML(t, sm)
+	tests := map[string]string{
+		"local-myapp":  "http://172.17.0.1:3000",
+		"local-tunnel": "http://10.0.0.5:3001",
+	}
+	for service, want := range tests {
+		servers, _ := lookup(config, "http", "services", service, "loadBalancer", "servers").([]any)
+		if len(servers) != 1 || lookup(servers[0], "url") != want {
+			t.Errorf("%s servers = %v, want url %s", service, servers, want)
+		}
+	}
+}
+
+func TestGenerateHealthCheck(t *testing.T) {
+	tests := []struct {
+		name                    string
+		path, interval, timeout string
+		want                    map[string]any
+	}{
+		{name: "unset"},
+		{
+			name: "path only",
+			path: "/healthz",
+			want: map[string]any{"path": "/healthz", "interval": "10s"},
+		},
+		{
+			name: "all set", path: "/ready", interval: "30s", timeout: "3s",
+			want: map[string]any{"path": "/ready", "interval": "30s", "timeout": "3s"},
+		},
+		{name: "interval without path", interval: "30s", timeout: "3s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HEALTHCHECK_PATH", tt.path)
+			t.Setenv("HEALTHCHECK_INTERVAL", tt.interval)
+			t.Setenv("HEALTHCHECK_TIMEOUT", tt.timeout)
+			sm := newTestManager(t)
+			sm.healthCheck = healthCheckFromEnv()
+			registerAll(t, sm, `{"id": "myapp", "port": 3000}`)
+
+			config := generateYAML(t, sm)
+			if lookup(config, "http", "services", "local-myapp", "healthCheck") != nil {
+				t.Fatal("healthCheck is a sibling of loadBalancer, Traefik ignores it there")
+			}
+			got := lookup(config, "http", "services", "local-myapp", "loadBalancer", "healthCheck")
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("healthCheck = %v, want none", got)
+				}
+				return
+			}
+			if m, _ := got.(map[string]any); !maps.Equal(m, tt.want) {
+				t.Errorf("loadBalancer.healthCheck = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeneratePassHostHeader(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name string
+		pass *bool
+		want any
+	}{
+		{"unset", nil, nil},
+		{"true", &yes, true},
+		{"false", &no, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestManager(t)
+			sm.passHostHeader = tt.pass
+			registerAll(t, sm, `{"id": "myapp", "port": 3000}`)
+
+			lb, _ := lookup(generateYAML(t, sm), "http", "services", "local-myapp", "loadBalancer").(map[string]any)
+			got, present := lb["passHostHeader"]
+			if present != (tt.pass != nil) || got != tt.want {
+				t.Errorf("passHostHeader = %v (present %t), want %v", got, present, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateHeadersMiddleware(t *testing.T) {
+	sm := newTestManager(t)
+	registerAll(t, sm, `{"id": "myapp", "port": 3000,
+		"request_headers": {"X-Debug": "1", "X-Remove": ""},
+		"response_headers": {"X-Served-By": "devrp"}}`)
+
+	config := generateYAML(t, sm)
+	headers, _ := lookup(config, "http", "middlewares", "headers-myapp", "headers").(map[string]any)
+	want := map[string]any{
+		"customRequestHeaders":  map[string]any{"X-Debug": "1", "X-Remove": ""},
+		"customResponseHeaders": map[string]any{"X-Served-By": "devrp"},
+	}
+	if len(headers) != len(want) {
+		t.Fatalf("headers middleware = %v, want keys customRequestHeaders and customResponseHeaders", headers)
+	}
+	for key, w := range want {
+		got, _ := headers[key].(map[string]any)
+		if !maps.Equal(got, w.(map[string]any)) {
+			t.Errorf("%s = %v, want %v", key, headers[key], w)
+		}
+	}
+	middlewares, _ := lookup(config, "http", "routers", "sub-myapp", "middlewares").([]any)
+	if !slices.Contains(middlewares, any("headers-myapp")) {
+		t.Errorf("router middlewares = %v, want headers-myapp", middlewares)
+	}
+}
+
+func TestGeneratePathPriorities(t *testing.T) {
+	sm := newTestManager(t)
+	registerAll(t, sm,
+		`{"id": "nested", "ports": [{"path": "/", "port": 3000}, {"path": "/api", "port": 4000}, {"path": "/api/v2", "port": 5000}]}`,
+		`{"id": "custom", "priority": 20, "ports": [{"path": "/", "port": 3001}, {"path": "/api", "port": 4001}]}`,
+		`{"id": "single", "port": 3002, "priority": 7}`,
+		`{"id": "plain", "port": 3003}`,
+	)
+
+	routers := lookup(generateYAML(t, sm), "http", "routers")
+	tests := map[string]any{
+		"sub-nested":   protocol.PathPriorityBase + 1,
+		"sub-nested~1": protocol.PathPriorityBase + 4,
+		"sub-nested~2": protocol.PathPriorityBase + 7,
+		"sub-custom":   20 + 1,
+		"sub-custom~1": 20 + 4,
+		"sub-single":   7,
+		"sub-plain":    nil,
+	}
+	for router, want := range tests {
+		if got := lookup(routers, router, "priority"); got != want {
+			t.Errorf("%s priority = %v, want %v", router, got, want)
+		}
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	sm := newTestManagerIn(dir)
+	registerAll(t, sm,
+		`{"id": "zeta", "port": 3000, "request_headers": {"X-B": "2", "X-A": "1", "X-C": "3"}}`,
+		`{"id": "alpha", "ports": [{"path": "/", "port": 3001}, {"path": "/api", "port": 4001}, {"path": "/ws", "port": 5001}]}`,
+		`{"id": "mid", "port": 3002, "info_root": true, "error_page": "builtin", "rate_limit": {"average": 5, "burst": 10}}`,
+	)
+	sm.saveState()
+	restarted := newTestManagerIn(dir)
+
+	for _, format := range []string{"yaml", "json"} {
+		sm.configFormat, restarted.configFormat = format, format
+		first, _, err := sm.generator.Generate(clientList(sm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 20 {
+			again, _, _ := sm.generator.Generate(clientList(sm))
+			if !bytes.Equal(first, again) {
+				t.Fatalf("%s: two generations from the same clients differ", format)
+			}
+		}
+		fromState, _, _ := restarted.generator.Generate(clientList(restarted))
+		if !bytes.Equal(first, fromState) {
+			t.Errorf("%s: generation after reloading the state differs:\n%s\nvs\n%s", format, first, fromState)
+		}
+	}
+}
+
+func TestJSONFormatKeepsYAMLFileName(t *testing.T) {
+	for _, perClient := range []bool{false, true} {
+		sm := newTestManager(t)
+		sm.configFormat = "json"
+		sm.perClientConfig = perClient
+		registerAll(t, sm, `{"id": "myapp", "port": 3000}`)
+		sm.generateConfig()
+
+		names := []string{"dynamic.yml"}
+		if perClient {
+			names = append(names, "client-myapp.yml")
+		}
+		for _, name := range names {
+			data, err := os.ReadFile(filepath.Join(sm.configDir, name))
+			if err != nil {
+				t.Errorf("per-client %t: %v", perClient, err)
+				continue
+			}
+			if !json.Valid(data) {
+				t.Errorf("per-client %t: %s is not JSON:\n%s", perClient, name, data)
+			}
+		}
+		matches, _ := filepath.Glob(filepath.Join(sm.configDir, "*.json"))
+		for _, path := range matches {
+			if filepath.Base(path) != "state.json" {
+				t.Errorf("per-client %t: wrote %s, which Traefik's file provider skips", perClient, path)
+			}
+		}
+	}
+}
+
+func TestGenerateConfigIgnoresRegistrationOrder(t *testing.T) {
+	bodies := []string{
+		`{"id": "zeta", "port": 3000}`,
+		`{"id": "alpha", "port": 3001}`,
+		`{"id": "mid", "port": 3002, "request_headers": {"X-B": "2", "X-A": "1"}}`,
+	}
+	var written [][]byte
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}} {
+		sm := newTestManager(t)
+		for _, i := range order {
+			registerAll(t, sm, bodies[i])
+		}
+		sm.generateConfig()
+		data, err := os.ReadFile(filepath.Join(sm.configDir, "dynamic.yml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, data)
+	}
+	if !bytes.Equal(written[0], written[1]) {
+		t.Errorf("config depends on registration order:\n%s\nvs\n%s", written[0], written[1])
+	}
+}
+
+func TestGenerateSticky(t *testing.T) {
+	sm := newTestManager(t)
+	registerAll(t, sm,
+		`{"id": "plain", "port": 3000}`,
+		`{"id": "sticky", "sticky": true, "ports": [{"path": "/", "port": 3001}, {"path": "/api", "port": 4001}]}`,
+	)
+
+	services := lookup(generateYAML(t, sm), "http", "services")
+	tests := map[string]bool{
+		"local-plain":    false,
+		"local-sticky":   true,
+		"local-sticky~1": true,
+	}
+	for service, sticky := range tests {
+		lb, _ := lookup(services, service, "loadBalancer").(map[string]any)
+		if lb == nil {
+			t.Fatalf("service %s missing", service)
+		}
+		_, hasSticky := lb["sticky"]
+		cookie, isMap := lookup(lb, "sticky", "cookie").(map[string]any)
+		switch {
+		case !sticky && hasSticky:
+			t.Errorf("%s: loadBalancer.sticky = %v, want none", service, lb["sticky"])
+		case sticky && !isMap:
+			t.Errorf("%s: loadBalancer.sticky.cookie missing: %v", service, lb["sticky"])
+		case sticky && len(cookie) != 0:
+			t.Errorf("%s: cookie = %v, want Traefik's defaults", service, cookie)
+		}
+	}
+}
+
+func TestSecureRouterNameIsUnique(t *testing.T) {
+	sm := newTestManager(t)
+	sm.tlsEntryPoint = "websecure"
+	registerAll(t, sm,
+		`{"id": "foo", "port": 3000}`,
+		`{"id": "foo-secure", "port": 3001}`,
+	)
+	routers := lookup(generateYAML(t, sm), "http", "routers").(map[string]any)
+	if len(routers) != 4 {
+		t.Fatalf("got routers %v, want an HTTP and a TLS router per client", slices.Sorted(maps.Keys(routers)))
+	}
+	if got := lookup(routers, "sub-foo-secure", "service"); got != "local-foo-secure" {
+		t.Errorf("sub-foo-secure routes to %v, want local-foo-secure", got)
+	}
+}
+
+func TestMappingNamesAreUnique(t *testing.T) {
+	sm := newTestManager(t)
+	registerAll(t, sm,
+		`{"id": "myapp", "port": 3000, "ports": [{"path": "/api", "port": 4000}]}`,
+		`{"id": "myapp-1", "port": 3001}`,
+	)
+	config := generateYAML(t, sm)
+	routers := lookup(config, "http", "routers").(map[string]any)
+	if len(routers) != 3 {
+		t.Fatalf("got routers %v, want myapp's two and myapp-1's", slices.Sorted(maps.Keys(routers)))
+	}
+	services := lookup(config, "http", "services").(map[string]any)
+	if len(services) != 3 {
+		t.Errorf("got services %v, want myapp's two and myapp-1's", slices.Sorted(maps.Keys(services)))
+	}
+}
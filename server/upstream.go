@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const upstreamResolveInterval = 30 * time.Second
+
+// upstreamStatus is the result of the last TARGET_HOST resolution.
+type upstreamStatus struct {
+	Addresses []string
+	Err       error
+	CheckedAt time.Time
+}
+
+// resolveUpstream resolves the upstream host immediately and then every
+// upstreamResolveInterval, so a host Traefik can't resolve shows up in
+// /status instead of as silent 502s.
+func (sm *ServerManager) resolveUpstream(ctx context.Context) {
+	sm.resolveUpstreamOnce(ctx)
+
+	ticker := time.NewTicker(upstreamResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sm.resolveUpstreamOnce(ctx)
+		}
+	}
+}
+
+func (sm *ServerManager) resolveUpstreamOnce(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, sm.upstreamHost)
+	if err != nil {
+		slog.Warn("Failed to resolve upstream host", "host", sm.upstreamHost, "error", err)
+	}
+
+	sm.mu.Lock()
+	prev := sm.upstream
+	sm.upstream = &upstreamStatus{
+		Addresses: addrs,
+		Err:       err,
+		CheckedAt: time.Now(),
+	}
+	sm.mu.Unlock()
+
+	if err == nil && (prev == nil || prev.Err != nil) {
+		slog.Info("Upstream host resolved", "host", sm.upstreamHost, "addresses", addrs)
+	}
+}
@@ -1,10 +1,49 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var infoTemplate = template.Must(template.New("info").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Domain}}</title></head>
+<body>
+<h1>{{.Domain}}</h1>
+<ul>
+<li>Port: {{.Port}}</li>
+<li>Last heartbeat: {{.LastHeartbeat}}</li>
+</ul>
+</body>
+</html>
+`))
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Text}}</title></head>
+<body>
+<h1>{{.Domain}} is unavailable</h1>
+<p>The dev server answered {{.Status}} {{.Text}}. It may be restarting or have crashed.</p>
+</body>
+</html>
+`))
+
+var serviceRefRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+(@[a-zA-Z0-9_-]+)?$`)
+
+// validateServiceRef checks a Traefik service reference like "errors" or
+// "errors@docker".
+func validateServiceRef(ref string) bool {
+	return serviceRefRegex.MatchString(ref)
+}
+
 var subdomainPartRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
 
 func validateSubdomain(subdomain string) bool {
@@ -23,6 +62,214 @@ func validateSubdomain(subdomain string) bool {
 	return true
 }
 
+// validateHost accepts an IP address or a DNS hostname.
+func validateHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	return len(host) <= 253 && validateSubdomain(host)
+}
+
+// parseReserved parses a comma-separated list of reserved first labels into
+// a lowercase set.
+func parseReserved(list string) map[string]bool {
+	reserved := make(map[string]bool)
+	for _, label := range strings.Split(list, ",") {
+		if label = strings.ToLower(strings.TrimSpace(label)); label != "" {
+			reserved[label] = true
+		}
+	}
+	return reserved
+}
+
+// validateBindAddr reports whether addr is a listen address like :8080,
+// 127.0.0.1:8080 or [::1]:8080.
+func validateBindAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return false
+	}
+	return host == "" || validateHost(host)
+}
+
+// parseList splits a comma-separated setting, dropping empty entries.
+func parseList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// unbracket strips the brackets from an IPv6 literal like [::1], so it can
+// be validated and later joined with a port.
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// validateScheme reports whether scheme is one Traefik can forward to.
+func validateScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// into place, so readers like Traefik's file watcher never see a partial
+// file. The temp file ends in .tmp, which Traefik's file provider ignores.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkWritable creates and removes a temp file in dir, the same way
+// writeFileAtomic does, to find out whether config writes can succeed.
+func checkWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".write-check.*.tmp")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+var headerNameRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// maxCustomHeaders caps request_headers and response_headers each.
+const maxCustomHeaders = 50
+
+// validateHeaders checks custom header names are HTTP tokens and values
+// contain no control characters. An empty value is allowed; Traefik uses it
+// to remove the header.
+func validateHeaders(headers map[string]string) bool {
+	if len(headers) > maxCustomHeaders {
+		return false
+	}
+	for name, value := range headers {
+		if !headerNameRegex.MatchString(name) || len(value) > 4096 {
+			return false
+		}
+		for _, r := range value {
+			if r < 0x20 && r != '\t' || r == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var labelKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/-]{0,61}[a-zA-Z0-9])?$`)
+
+// maxLabels caps the labels a client can attach.
+const maxLabels = 32
+
+// validateLabels bounds client labels: at most maxLabels, keys of up to 63
+// letters, digits and ._/- starting and ending alphanumeric, and values of
+// up to 256 characters without control characters.
+func validateLabels(labels map[string]string) bool {
+	if len(labels) > maxLabels {
+		return false
+	}
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) || len(value) > 256 {
+			return false
+		}
+		for _, r := range value {
+			if r < 0x20 || r == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var pathPrefixRegex = regexp.MustCompile(`^/[a-zA-Z0-9._~/-]*$`)
+
+// validatePathPrefix accepts URL paths safe to embed in a PathPrefix rule.
+func validatePathPrefix(path string) bool {
+	return len(path) <= 256 && pathPrefixRegex.MatchString(path)
+}
+
+// toInternalID maps a subdomain to the key clients are stored under. Host
+// names are case-insensitive, so it lowercases as well.
 func toInternalID(subdomain string) string {
-	return strings.ReplaceAll(subdomain, ".", "_")
+	return strings.ReplaceAll(strings.ToLower(subdomain), ".", "_")
+}
+
+var byteSizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+}
+
+// parseByteSize parses sizes like "1048576", "512KB" or "10MiB" into bytes.
+// Decimal units (KB, MB, GB) are powers of 1000, binary units (KiB, MiB, GiB)
+// are powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, errors.New("missing number")
+	}
+
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	unit, ok := byteSizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, errors.New("unknown unit")
+	}
+	if n > (1<<63-1)/unit {
+		return 0, errors.New("size overflows int64")
+	}
+	return n * unit, nil
+}
+
+// parseHeartbeatTimeout parses HEARTBEAT_TIMEOUT, which must be at least
+// minHeartbeatTimeout.
+func parseHeartbeatTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < minHeartbeatTimeout {
+		return 0, fmt.Errorf("must be at least %v", minHeartbeatTimeout)
+	}
+	return d, nil
 }
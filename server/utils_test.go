@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkWritable(dir); err != nil {
+		t.Fatalf("writable dir: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("probe file left behind: %v", entries)
+	}
+
+	// Permission bits don't stop root, which the tests may run as, so the
+	// unwritable cases are paths no one can create files in.
+	file := filepath.Join(dir, "config")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	unwritable := []string{file, filepath.Join(dir, "missing")}
+	if runtime.GOOS == "linux" {
+		unwritable = append(unwritable, "/proc")
+	}
+	if os.Geteuid() > 0 {
+		readOnly := filepath.Join(dir, "read-only")
+		if err := os.Mkdir(readOnly, 0555); err != nil {
+			t.Fatal(err)
+		}
+		unwritable = append(unwritable, readOnly)
+	}
+	for _, path := range unwritable {
+		if err := checkWritable(path); err == nil {
+			t.Errorf("checkWritable(%s) succeeded, want an error", path)
+		}
+	}
+}
+
+func TestParseHeartbeatTimeout(t *testing.T) {
+	tests := map[string]bool{
+		"30s":  true,
+		"1s":   true,
+		"2m":   true,
+		"0s":   false,
+		"1ns":  false,
+		"-30s": false,
+		"30":   false,
+	}
+	for v, ok := range tests {
+		d, err := parseHeartbeatTimeout(v)
+		if (err == nil) != ok {
+			t.Errorf("%q: got %v, %v; want ok %t", v, d, err, ok)
+		}
+	}
+}
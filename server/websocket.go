@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UfukUstali/dev-reverse-proxy/internal/protocol"
+)
+
+// websocketGUID is the fixed key suffix of the RFC 6455 handshake.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+const (
+	// wsPingInterval is how often /ws pings its peer. A peer that sends
+	// nothing, not even a pong, for wsReadTimeout is disconnected.
+	wsPingInterval = 30 * time.Second
+	wsReadTimeout  = 75 * time.Second
+
+	// wsMaxFrame caps frames read from the peer; /ws only expects control
+	// frames from it.
+	wsMaxFrame = 64 << 10
+
+	// defaultWSMaxConnections bounds concurrent /ws connections unless
+	// WS_MAX_CONNECTIONS is set.
+	defaultWSMaxConnections = 100
+)
+
+// snapshotEvent is the first message on /ws: every client registered at
+// connect time.
+type snapshotEvent struct {
+	Event   string                `json:"event"`
+	Time    string                `json:"time"`
+	Clients []protocol.ClientView `json:"clients"`
+}
+
+// wsConn is a server side WebSocket connection. Writes come from both the
+// event loop and the reader answering pings, so they go through mu.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readFrame reads one frame from the peer, unmasking its payload.
+// Fragmented messages aren't reassembled; /ws ignores data frames anyway.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7F)
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	if n > wsMaxFrame {
+		return 0, nil, errors.New("frame too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// headerHasToken reports whether the comma-separated header contains token,
+// ignoring case, e.g. "keep-alive, Upgrade" contains "upgrade".
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebSocket serves /ws: a WebSocket that first sends a snapshot of all
+// clients and then the same events as /events, as JSON text messages.
+func (sm *ServerManager) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	if int(sm.wsConns.Add(1)) > sm.wsMaxConnections {
+		sm.wsConns.Add(-1)
+		slog.Warn("WebSocket rejected, connection limit reached", "event", "ws_limit", "max_connections", sm.wsMaxConnections)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer sm.wsConns.Add(-1)
+
+	// Subscribe before taking the snapshot, so no change falls in between.
+	ch, ok := sm.events.subscribe()
+	if !ok {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer sm.events.unsubscribe(ch)
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket unsupported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	ws := &wsConn{conn: conn, rw: rw}
+
+	sm.mu.RLock()
+	snapshot := snapshotEvent{
+		Event:   "snapshot",
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Clients: make([]protocol.ClientView, 0, len(sm.clients)),
+	}
+	for _, client := range sm.clients {
+		snapshot.Clients = append(snapshot.Clients, sm.clientView(client))
+	}
+	sm.mu.RUnlock()
+
+	data, _ := json.Marshal(snapshot)
+	if err := ws.writeFrame(wsOpText, data); err != nil {
+		return
+	}
+
+	// The reader answers pings and notices when the peer closes or goes
+	// away; done stops the writer below.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+			opcode, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsOpClose:
+				ws.writeFrame(wsOpClose, nil)
+				return
+			case wsOpPing:
+				ws.writeFrame(wsOpPong, payload)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				ws.writeFrame(wsOpClose, nil)
+				return
+			}
+			if err := ws.writeFrame(wsOpText, msg.data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := ws.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}